@@ -0,0 +1,254 @@
+package book
+
+import (
+	"bytes"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/book"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	"gs/tool/env"
+	toolSql "gs/tool/sql"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 封面最大字节数
+	coverMaxSize = 5 * 1024 * 1024
+	// 封面最大边像素, 解码前检查, 避免尺寸过大的图片耗尽内存
+	coverMaxPixel = 8000
+	// 缩略图最大边像素
+	coverThumbnailSize = 200
+	// 下载数据块字节数
+	coverChunkSize = 64 * 1024
+)
+
+// 封面文件路径
+//
+// 图书编码可能包含特殊字符, 文件名使用哈希
+func coverFilePath(code string, thumbnail bool) string {
+	name := tool.Sha256Hash(code)
+	if thumbnail {
+		name = fmt.Sprint(name, "-thumbnail")
+	}
+	return filepath.Join(env.CoverPath, name)
+}
+
+// 写入文件, 先写临时文件再重命名, 避免下载时读到不完整的文件
+func writeCoverFile(path string, data []byte) error {
+	f, e := os.CreateTemp(env.CoverPath, "upload-")
+	if e != nil {
+		return e
+	}
+	_, e = f.Write(data)
+	if e != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return e
+	}
+	e = f.Close()
+	if e != nil {
+		os.Remove(f.Name())
+		return e
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// 生成缩略图(区域平均采样)
+func thumbnail(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+	tw, th := maxSize, h*maxSize/w
+	if h > w {
+		tw, th = w*maxSize/h, maxSize
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+func (s *server) UploadCover(stream book.Book_UploadCoverServer) error {
+	ctx := stream.Context()
+
+	// 接收数据
+	var code string
+	var buf bytes.Buffer
+	for {
+		chunk, e := stream.Recv()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return e
+		}
+		if code == "" {
+			code = chunk.GetCode()
+			if code == "" {
+				return status.Errorf(codes.InvalidArgument, "需要图书编码")
+			}
+		}
+		if buf.Len()+len(chunk.GetData()) > coverMaxSize {
+			return status.Errorf(codes.InvalidArgument, "封面不能超过5MB")
+		}
+		buf.Write(chunk.GetData())
+	}
+	if buf.Len() == 0 {
+		return status.Errorf(codes.InvalidArgument, "需要图片数据")
+	}
+
+	// 检查图片
+	contentType := http.DetectContentType(buf.Bytes())
+	if tool.ArrayIndex(contentType, []string{"image/jpeg", "image/png", "image/gif"}) == -1 {
+		return status.Errorf(codes.InvalidArgument, "图片类型无效, 只支持JPEG,PNG,GIF")
+	}
+	config, _, e := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if e != nil {
+		return status.Errorf(codes.InvalidArgument, "图片无效")
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > coverMaxPixel || config.Height > coverMaxPixel {
+		return status.Errorf(codes.InvalidArgument, "图片宽高必须在1到%d像素以内", coverMaxPixel)
+	}
+	img, _, e := image.Decode(bytes.NewReader(buf.Bytes()))
+	if e != nil {
+		return status.Errorf(codes.InvalidArgument, "图片无效")
+	}
+
+	// 生成缩略图
+	var thumbnailBuf bytes.Buffer
+	e = jpeg.Encode(&thumbnailBuf, thumbnail(img, coverThumbnailSize), &jpeg.Options{Quality: 85})
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 保存入库
+	info := book.CoverInfo{
+		ContentType: contentType,
+		Size:        int64(buf.Len()),
+		Width:       int32(img.Bounds().Dx()),
+		Height:      int32(img.Bounds().Dy()),
+		DateText:    time.Now().Format("2006-01-02T15:04:05"),
+	}
+	infoText, _ := toolApi.ProtoToJson(&info)
+	ct, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = jsonb_set(j, '{cover}', '%s') where j->>'code' = '%s';`, toolSql.TableNameBook, infoText, code))
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		e = fmt.Errorf("图书编码无效")
+		return status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 入库成功后保存文件, 保存失败时回滚
+	e = writeCoverFile(coverFilePath(code, false), buf.Bytes())
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+	e = writeCoverFile(coverFilePath(code, true), thumbnailBuf.Bytes())
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+
+	return stream.SendAndClose(&info)
+}
+
+func (s *server) DownloadCover(in *book.DownloadCoverRequest, stream book.Book_DownloadCoverServer) error {
+	ctx := stream.Context()
+
+	if in.GetCode() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+
+	// 查询封面
+	var contentType string
+	e := sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(j->'cover'->>'content_type', '') from %s where j->>'code' = '%s'`, toolSql.TableNameBook, in.GetCode())).Scan(&contentType)
+	if e == pgx.ErrNoRows {
+		return status.Errorf(codes.InvalidArgument, "图书编码无效")
+	} else if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+	if contentType == "" {
+		return status.Errorf(codes.NotFound, "没有封面")
+	}
+	if in.GetThumbnail() {
+		contentType = "image/jpeg"
+	}
+
+	// 读取文件
+	data, e := os.ReadFile(coverFilePath(in.GetCode(), in.GetThumbnail()))
+	if os.IsNotExist(e) {
+		return status.Errorf(codes.NotFound, "没有封面")
+	} else if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 发送数据
+	for start := 0; start < len(data); start += coverChunkSize {
+		end := start + coverChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := book.CoverChunk{Data: data[start:end]}
+		if start == 0 {
+			chunk.Code = in.GetCode()
+			chunk.ContentType = contentType
+		}
+		e = stream.Send(&chunk)
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
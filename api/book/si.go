@@ -3,12 +3,21 @@ package book
 import (
 	"context"
 	"fmt"
+	"gs/filelog"
 	"gs/proto/book"
 	"gs/tool"
 	toolApi "gs/tool/api"
+	"gs/tool/env"
+	toolHolder "gs/tool/holder"
+	toolIdempotency "gs/tool/idempotency"
+	toolOutbox "gs/tool/outbox"
+	toolRole "gs/tool/role"
 	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	"os"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -22,11 +31,59 @@ type server struct {
 
 var sdb *pgxpool.Pool
 
+func checkCopyInfoRequest(in *book.CopyInfo) error {
+	if in.GetBarcode() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要副本条码")
+	}
+	if tool.ArrayIndex(in.GetState(), []string{"在架", "遗失", "维修"}) == -1 {
+		return status.Errorf(codes.InvalidArgument, "状态无效")
+	}
+
+	return nil
+}
+
+// errCopyCount 副本计算的库存数量小于借出数量
+var errCopyCount = fmt.Errorf("库存数量不能小于借出数量")
+
+// 根据副本状态更新在馆库存和图书库存数量
+//
+// 返回库存数量的变化和更新后的库存数量, 库存数量小于借出数量时返回 errCopyCount
+func syncCopyCount(ctx context.Context, t pgx.Tx, code string) (int32, int32, error) {
+	var totalCount int32
+	e := t.QueryRow(ctx, fmt.Sprintf(`select coalesce(cast(j->>'total_count' as integer), 0) from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, code)).Scan(&totalCount)
+	if e != nil {
+		return 0, 0, e
+	}
+
+	e = toolStock.SyncCopy(ctx, t, code)
+	if e != nil {
+		return 0, 0, e
+	}
+
+	var newTotalCount, newBorrowCount int32
+	e = t.QueryRow(ctx, fmt.Sprintf(`select cast(j->>'total_count' as integer), cast(j->>'borrow_count' as integer) from %s where j->>'code' = '%s'`, toolSql.TableNameBook, code)).Scan(&newTotalCount, &newBorrowCount)
+	if e != nil {
+		return 0, 0, e
+	}
+	if newTotalCount < newBorrowCount {
+		return 0, 0, errCopyCount
+	}
+
+	return newTotalCount - totalCount, newTotalCount, nil
+}
+
 // Register 注册服务, 传递公共资源
 func Register(s grpc.ServiceRegistrar) {
 	book.RegisterBookServer(s, &server{})
 
 	sdb = toolSql.GetDb()
+
+	// 创建封面目录
+	e := os.MkdirAll(env.CoverPath, 0755)
+	if e != nil {
+		filelog.Warn("创建封面目录失败", e)
+		os.Exit(1)
+	}
 }
 
 func (s *server) Add(ctx context.Context, in *book.Info) (*book.Empty, error) {
@@ -37,9 +94,62 @@ func (s *server) Add(ctx context.Context, in *book.Info) (*book.Empty, error) {
 		return nil, status.Errorf(codes.InvalidArgument, "状态无效")
 	}
 
+	if in.GetTotalCount() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "库存数量不能小于0")
+	}
+
+	// 借出数量由借还维护, 封面由上传维护, 分类和标签由分类服务维护
+	in.BorrowCount = 0
+	in.Cover = nil
+	in.CategoryCodes = nil
+	in.Tags = nil
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 上下文中获取用户名
+	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	// 幂等键: 保留期内重复请求返回原来的结果
+	idempotencyKey, error := toolIdempotency.GetKey(ctx)
+	if error != nil {
+		e = error
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+	if idempotencyKey != "" {
+		response, error := toolIdempotency.Check(ctx, t, idempotencyKey, username, in)
+		if error == toolIdempotency.ErrMismatch {
+			e = error
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		} else if error != nil {
+			e = error
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if response != "" {
+			var result book.Empty
+			e = toolApi.JsonToProto(response, &result)
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			return &result, nil
+		}
+	}
+
 	// 保存入库
 	inText, _ := toolApi.ProtoToJson(in)
-	ct, e := sdb.Exec(context.Background(), fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameBook, inText))
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameBook, inText))
 	if e != nil {
 		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
 			return nil, status.Errorf(codes.InvalidArgument, "图书编码重复")
@@ -48,7 +158,43 @@ func (s *server) Add(ctx context.Context, in *book.Info) (*book.Empty, error) {
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
 	if ct.RowsAffected() == 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "保存失败")
+		e = fmt.Errorf("保存失败")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 库存归入默认馆
+	e = toolStock.Change(ctx, t, in.GetCode(), toolSql.DefaultLocationCode, in.GetTotalCount(), 0)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 记录库存调整
+	if in.GetTotalCount() > 0 {
+		e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+			Code:         in.GetCode(),
+			Type:         "采购",
+			Count:        in.GetTotalCount(),
+			Reason:       "增加图书",
+			TotalCount:   in.GetTotalCount(),
+			LocationCode: toolSql.DefaultLocationCode,
+		})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 记录事件
+	e = toolOutbox.Add(ctx, t, "图书增加", in)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 保存幂等键结果
+	if idempotencyKey != "" {
+		e = toolIdempotency.Save(ctx, t, idempotencyKey, username, &book.Empty{})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
 	}
 
 	return &book.Empty{}, nil
@@ -62,13 +208,96 @@ func (s *server) Change(ctx context.Context, in *book.Info) (*book.Empty, error)
 		return nil, status.Errorf(codes.InvalidArgument, "状态无效")
 	}
 
-	// 保存入库
-	ct, e := sdb.Exec(context.Background(), fmt.Sprintf(`update %s set j = j || '{"name": "%s", "total_count": %d, "state": "%s"}' where j->>'code' = '%s';`, toolSql.TableNameBook, in.GetName(), in.GetTotalCount(), in.GetState(), in.GetCode()))
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
 	if e != nil {
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
-	if ct.RowsAffected() == 0 {
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定图书
+	var totalCount, borrowCount int32
+	e = t.QueryRow(ctx, fmt.Sprintf(`select coalesce(cast(j->>'total_count' as integer), 0), coalesce(cast(j->>'borrow_count' as integer), 0) from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, in.GetCode())).Scan(&totalCount, &borrowCount)
+	if e == pgx.ErrNoRows {
 		return nil, status.Errorf(codes.InvalidArgument, "图书编码无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 登记副本的图书, 库存数量由副本计算
+	var copyCount int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameBookCopy, in.GetCode())).Scan(&copyCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	newTotalCount := in.GetTotalCount()
+	if copyCount > 0 {
+		newTotalCount = totalCount
+	}
+
+	// 检查库存
+	if newTotalCount < borrowCount {
+		e = fmt.Errorf("库存数量不能小于借出数量")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+	if in.GetState() == "删除" && borrowCount > 0 {
+		e = fmt.Errorf("图书还有借出, 不能删除")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 保存入库
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"name": "%s", "state": "%s"}' where j->>'code' = '%s';`, toolSql.TableNameBook, in.GetName(), in.GetState(), in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 库存数量变化计入默认馆
+	if newTotalCount != totalCount {
+		e = toolStock.Change(ctx, t, in.GetCode(), toolSql.DefaultLocationCode, newTotalCount-totalCount, 0)
+		if e == toolStock.ErrCount {
+			return nil, status.Errorf(codes.InvalidArgument, "%s库存数量不能小于借出数量", toolSql.DefaultLocationCode)
+		} else if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 记录库存调整
+	if newTotalCount != totalCount {
+		e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+			Code:         in.GetCode(),
+			Type:         "更正",
+			Count:        newTotalCount - totalCount,
+			Reason:       "修改图书",
+			TotalCount:   newTotalCount,
+			LocationCode: toolSql.DefaultLocationCode,
+		})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 记录事件
+	var bookText string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'code' = '%s'`, toolSql.TableNameBook, in.GetCode())).Scan(&bookText)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var bookInfo book.Info
+	e = toolApi.JsonToProto(bookText, &bookInfo)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	e = toolOutbox.Add(ctx, t, "图书修改", &bookInfo)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
 	}
 
 	return &book.Empty{}, nil
@@ -86,6 +315,25 @@ func (s *server) Search(ctx context.Context, in *book.SearchRequest) (*book.Sear
 			fmt.Sprint(`%`, in.Keyword, `%`),
 		)
 	}
+	if in.GetCategoryCode() != "" {
+		// 分类路径, 作为前缀匹配下级分类时转义 LIKE 通配符
+		var path string
+		e := sdb.QueryRow(ctx, fmt.Sprintf(`select j->>'path' from %s where j->>'code' = $1`, toolSql.TableNameCategory), in.GetCategoryCode()).Scan(&path)
+		if e == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, "分类编码无效")
+		} else if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		pathPattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(path)
+		sqlWhere = fmt.Sprintf(`%s and j->'category_codes' ?| array(select c.j->>'code' from %s as c where c.j->>'path' like '%s%%')`,
+			sqlWhere,
+			toolSql.TableNameCategory,
+			pathPattern,
+		)
+	}
+	if in.GetTag() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->'tags' ? '%s'`, sqlWhere, in.GetTag())
+	}
 
 	sqlCount := fmt.Sprintf(`select count(*) from %s as me where %s`, toolSql.TableNameBook, sqlWhere)
 	sqlMain := fmt.Sprintf(`select j from %s where %s order by j->>'code'`, toolSql.TableNameBook, sqlWhere)
@@ -121,6 +369,351 @@ func (s *server) Search(ctx context.Context, in *book.SearchRequest) (*book.Sear
 		}
 		infoArray = append(infoArray, &info)
 	}
-	result := book.SearchResponse{Count: count, InfoArray: infoArray}
+
+	// 按分类统计
+	rows, e = sdb.Query(ctx, fmt.Sprintf(`select c, count(*) from %s, jsonb_array_elements_text(coalesce(j->'category_codes', '[]')) as c where %s group by c order by c`, toolSql.TableNameBook, sqlWhere))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var categoryCountArray []*book.CategoryCount
+	for rows.Next() {
+		var categoryCount book.CategoryCount
+		e = rows.Scan(&categoryCount.CategoryCode, &categoryCount.Count)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		categoryCountArray = append(categoryCountArray, &categoryCount)
+	}
+
+	result := book.SearchResponse{Count: count, InfoArray: infoArray, CategoryCountArray: categoryCountArray}
+	return &result, nil
+}
+
+// 按图书编码查询, 返回图书编码和信息的映射
+func getBookMap(ctx context.Context, codeArray []string) (map[string]*book.Info, error) {
+	sqlIn := make([]string, len(codeArray))
+	for i, v := range codeArray {
+		sqlIn[i] = fmt.Sprintf(`'%s'`, v)
+	}
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select j from %s where j->>'code' in (%s)`, toolSql.TableNameBook, strings.Join(sqlIn, ",")))
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	infoMap := make(map[string]*book.Info)
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, e
+		}
+		var info book.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, e
+		}
+		infoMap[info.GetCode()] = &info
+	}
+	return infoMap, rows.Err()
+}
+
+func (s *server) Get(ctx context.Context, in *book.GetRequest) (*book.Info, error) {
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+
+	infoMap, e := getBookMap(ctx, []string{in.GetCode()})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	info, exists := infoMap[in.GetCode()]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "图书编码不存在")
+	}
+
+	return info, nil
+}
+
+func (s *server) Detail(ctx context.Context, in *book.GetRequest) (*book.DetailResponse, error) {
+	info, e := s.Get(ctx, in)
+	if e != nil {
+		return nil, e
+	}
+	result := book.DetailResponse{Info: info}
+
+	// 在馆库存
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select j from %s where j->>'code' = '%s' order by j->>'location_code'`, toolSql.TableNameBookStock, in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var stockInfo book.StockInfo
+		e = toolApi.JsonToProto(jsonText, &stockInfo)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		result.StockArray = append(result.StockArray, &stockInfo)
+	}
+
+	// 在借用户仅馆员可见
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) == toolRole.Librarian {
+		holders, e := toolHolder.Holders(ctx, sdb, in.GetCode())
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		for _, v := range holders {
+			result.HolderArray = append(result.HolderArray, &book.HolderInfo{Username: v.Username, Count: v.Count, DueDate: v.DueDate})
+		}
+	}
+
+	return &result, nil
+}
+
+func (s *server) BatchGet(ctx context.Context, in *book.BatchGetRequest) (*book.BatchGetResponse, error) {
+	if len(in.GetCodes()) == 0 || len(in.GetCodes()) > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "图书编码数量必须在1到100以内")
+	}
+	for _, v := range in.GetCodes() {
+		if v == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+		}
+	}
+
+	infoMap, e := getBookMap(ctx, in.GetCodes())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 按请求顺序返回
+	var infoArray []*book.Info
+	var notFoundArray []string
+	for _, v := range in.GetCodes() {
+		info, exists := infoMap[v]
+		if !exists {
+			notFoundArray = append(notFoundArray, v)
+			continue
+		}
+		infoArray = append(infoArray, info)
+	}
+	if len(notFoundArray) > 0 {
+		return nil, status.Errorf(codes.NotFound, "图书编码不存在:%s", strings.Join(notFoundArray, ","))
+	}
+
+	return &book.BatchGetResponse{InfoArray: infoArray}, nil
+}
+
+func (s *server) AddCopy(ctx context.Context, in *book.CopyInfo) (*book.Empty, error) {
+	// 基本校验
+	e := checkCopyInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+	in.LocationCode = toolStock.LocationCode(in.GetLocationCode())
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定图书
+	var code string
+	var borrowCount int32
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j->>'code', coalesce(cast(j->>'borrow_count' as integer), 0) from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, in.GetCode())).Scan(&code, &borrowCount)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.InvalidArgument, "图书编码无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 按数量借出的图书登记副本后无法按副本归还, 需要先全部归还
+	var copyCount int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameBookCopy, code)).Scan(&copyCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if copyCount == 0 && borrowCount > 0 {
+		e = fmt.Errorf("图书还有按数量借出, 全部归还后才能登记副本")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 检查馆
+	locationOk, e := toolStock.LocationOk(ctx, t, in.GetLocationCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if !locationOk {
+		e = fmt.Errorf("馆编码无效")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 保存入库
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameBookCopy, inText))
+	if e != nil {
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, status.Errorf(codes.InvalidArgument, "副本条码重复")
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		e = fmt.Errorf("保存失败")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 更新图书数量
+	diffCount, totalCount, e := syncCopyCount(ctx, t, code)
+	if e == errCopyCount {
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 记录库存调整: 第一个副本由按数量改为按副本计算库存, 记为更正
+	if diffCount != 0 {
+		adjustType := "采购"
+		if copyCount == 0 {
+			adjustType = "更正"
+		}
+		e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+			Code:         code,
+			Type:         adjustType,
+			Count:        diffCount,
+			Reason:       fmt.Sprint("增加副本:", in.GetBarcode()),
+			TotalCount:   totalCount,
+			LocationCode: in.GetLocationCode(),
+		})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	return &book.Empty{}, nil
+}
+
+func (s *server) ChangeCopy(ctx context.Context, in *book.CopyInfo) (*book.Empty, error) {
+	// 基本校验
+	e := checkCopyInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 保存入库(借出的副本需要先归还)
+	var code, locationCode string
+	e = t.QueryRow(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "%s", "location": "%s"}' where j->>'barcode' = '%s' and j->>'state' != '借出' returning j->>'code', j->>'location_code';`, toolSql.TableNameBookCopy, in.GetState(), in.GetLocation(), in.GetBarcode())).Scan(&code, &locationCode)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.InvalidArgument, "副本条码无效或副本已借出")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 更新图书数量
+	diffCount, totalCount, e := syncCopyCount(ctx, t, code)
+	if e == errCopyCount {
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 记录库存调整
+	if diffCount != 0 {
+		adjustType := "更正"
+		if in.GetState() == "遗失" {
+			adjustType = "遗失"
+		} else if in.GetState() == "维修" {
+			adjustType = "损坏"
+		}
+		e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+			Code:         code,
+			Type:         adjustType,
+			Count:        diffCount,
+			Reason:       fmt.Sprint("修改副本:", in.GetBarcode()),
+			TotalCount:   totalCount,
+			LocationCode: locationCode,
+		})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	return &book.Empty{}, nil
+}
+
+func (s *server) SearchCopy(ctx context.Context, in *book.SearchCopyRequest) (*book.SearchCopyResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'code' = '%s'`, sqlWhere, in.GetCode())
+	}
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameBookCopy, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'barcode' offset %v limit %v`, toolSql.TableNameBookCopy, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*book.CopyInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info book.CopyInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := book.SearchCopyResponse{Count: count, InfoArray: infoArray}
 	return &result, nil
 }
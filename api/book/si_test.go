@@ -1,12 +1,20 @@
 package book
 
 import (
+	"bytes"
 	"context"
 	"gs/proto/book"
 	toolApi "gs/tool/api"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"log"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var mc context.Context
@@ -116,3 +124,272 @@ func TestSearch(t *testing.T) {
 	}
 	t.Log(result)
 }
+
+func TestSearchCategory(t *testing.T) {
+	result, e := gc.Search(mc, &book.SearchRequest{
+		PageStart:    1,
+		PageCount:    10,
+		CategoryCode: "T",
+		Tag:          "架构",
+	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestGet(t *testing.T) {
+	// 不存在
+	_, e := gc.Get(mc, &book.GetRequest{Code: "不存在"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("不存在", gs.Code(), gs.Message())
+	}
+
+	result, e := gc.Get(mc, &book.GetRequest{Code: "SN1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestDetail(t *testing.T) {
+	// 不存在
+	_, e := gc.Detail(mc, &book.GetRequest{Code: "不存在"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("不存在", gs.Code(), gs.Message())
+	}
+
+	// 在馆库存之和为图书库存数量
+	result, e := gc.Detail(mc, &book.GetRequest{Code: "SN1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var totalCount int32
+	for _, v := range result.GetStockArray() {
+		totalCount += v.GetTotalCount()
+	}
+	if totalCount != result.GetInfo().GetTotalCount() {
+		t.Fatal("在馆库存", totalCount, result.GetInfo().GetTotalCount())
+	}
+	t.Log(result)
+}
+
+func TestBatchGet(t *testing.T) {
+	result, e := gc.BatchGet(mc, &book.BatchGetRequest{Codes: []string{"SN2", "SN1"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.GetInfoArray()) != 2 || result.GetInfoArray()[0].GetCode() != "SN2" {
+		t.Fatal("请求顺序", result)
+	}
+	t.Log(result)
+}
+
+func TestAddCopy1(t *testing.T) {
+	result, e := gc.AddCopy(mc, &book.CopyInfo{
+		Barcode:  "SN3-001",
+		Code:     "SN3",
+		State:    "在架",
+		Location: "A区1架",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestAddCopy2(t *testing.T) {
+	result, e := gc.AddCopy(mc, &book.CopyInfo{
+		Barcode:  "SN3-002",
+		Code:     "SN3",
+		State:    "在架",
+		Location: "A区1架",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestChangeCopy(t *testing.T) {
+	result, e := gc.ChangeCopy(mc, &book.CopyInfo{
+		Barcode:  "SN3-002",
+		State:    "维修",
+		Location: "修补室",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestSearchCopy(t *testing.T) {
+	result, e := gc.SearchCopy(mc, &book.SearchCopyRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Code:      "SN3",
+	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestAdjustStock(t *testing.T) {
+	// 数量无效
+	_, e := gc.AdjustStock(mc, &book.StockAdjustInfo{
+		Code:   "SN1",
+		Type:   "采购",
+		Reason: "新书入库",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("数量无效", gs.Code(), gs.Message())
+	}
+
+	// 库存数量不能小于借出数量
+	_, e = gc.AdjustStock(mc, &book.StockAdjustInfo{
+		Code:   "SN1",
+		Type:   "报废",
+		Count:  10000,
+		Reason: "测试",
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("库存数量不能小于借出数量", gs.Code(), gs.Message())
+	}
+
+	// 正常调整
+	_, e = gc.AdjustStock(mc, &book.StockAdjustInfo{
+		Code:   "SN1",
+		Type:   "采购",
+		Count:  1,
+		Reason: "新书入库",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestSearchStockAdjust(t *testing.T) {
+	result, e := gc.SearchStockAdjust(mc, &book.SearchStockAdjustRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Code:      "SN1",
+	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestUploadCover(t *testing.T) {
+	// 生成图片
+	img := image.NewRGBA(image.Rect(0, 0, 600, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 600; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	e := png.Encode(&buf, img)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 分块上传
+	stream, e := gc.UploadCover(mc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	data := buf.Bytes()
+	for start := 0; start < len(data); start += 32 * 1024 {
+		end := start + 32*1024
+		if end > len(data) {
+			end = len(data)
+		}
+		e = stream.Send(&book.CoverChunk{Code: "SN1", Data: data[start:end]})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	result, e := stream.CloseAndRecv()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetContentType() != "image/png" || result.GetWidth() != 600 {
+		t.Fatal("封面信息", result)
+	}
+	t.Log(result)
+}
+
+func TestDownloadCover(t *testing.T) {
+	stream, e := gc.DownloadCover(mc, &book.DownloadCoverRequest{
+		Code:      "SN1",
+		Thumbnail: true,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	for {
+		chunk, e := stream.Recv()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+		buf.Write(chunk.GetData())
+	}
+	config, format, e := image.DecodeConfig(&buf)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if format != "jpeg" || config.Height != 200 {
+		t.Fatal("缩略图", format, config.Width, config.Height)
+	}
+	t.Log(format, config.Width, config.Height)
+}
+
+func TestTransfer(t *testing.T) {
+	result, e := gc.Transfer(mc, &book.TransferRequest{
+		Code:           "SN2",
+		ToLocationCode: "东区分馆",
+		Count:          1,
+		Reason:         "分馆开放",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestSearchStock(t *testing.T) {
+	result, e := gc.SearchStock(mc, &book.SearchStockRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Code:      "SN2",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
@@ -0,0 +1,370 @@
+package book
+
+import (
+	"context"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/book"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 保存库存调整
+func addStockAdjust(ctx context.Context, t pgx.Tx, info *book.StockAdjustInfo) error {
+	info.Id = uuid.New().String()
+	info.DateText = time.Now().Format("2006-01-02T15:04:05")
+	info.Username, _ = ctx.Value(toolApi.ContextKeyUserId).(string)
+	infoText, _ := toolApi.ProtoToJson(info)
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameStockAdjust, infoText))
+	if e != nil {
+		return e
+	}
+	if ct.RowsAffected() == 0 {
+		return fmt.Errorf("库存调整没有保存")
+	}
+
+	return nil
+}
+
+func (s *server) AdjustStock(ctx context.Context, in *book.StockAdjustInfo) (*book.Empty, error) {
+	// 基本校验
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+	if tool.ArrayIndex(in.GetType(), []string{"采购", "遗失", "损坏", "报废", "更正"}) == -1 {
+		return nil, status.Errorf(codes.InvalidArgument, "类型无效")
+	}
+	if in.GetType() == "更正" {
+		if in.GetCount() == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "数量不能为0")
+		}
+	} else if in.GetCount() < 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "数量必须大于0")
+	}
+	if in.GetReason() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要原因")
+	}
+	in.LocationCode = toolStock.LocationCode(in.GetLocationCode())
+
+	// 实际增减数量
+	diffCount := in.GetCount()
+	if tool.ArrayIndex(in.GetType(), []string{"遗失", "损坏", "报废"}) != -1 {
+		diffCount = -in.GetCount()
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定图书
+	var totalCount, borrowCount int32
+	e = t.QueryRow(ctx, fmt.Sprintf(`select coalesce(cast(j->>'total_count' as integer), 0), coalesce(cast(j->>'borrow_count' as integer), 0) from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, in.GetCode())).Scan(&totalCount, &borrowCount)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.InvalidArgument, "图书编码无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 登记副本的图书, 库存数量由副本计算
+	var copyCount int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameBookCopy, in.GetCode())).Scan(&copyCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if copyCount > 0 {
+		e = fmt.Errorf("图书已登记副本, 请修改副本状态")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 检查库存
+	newTotalCount := totalCount + diffCount
+	if newTotalCount < borrowCount {
+		e = fmt.Errorf("库存数量不能小于借出数量")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 检查馆
+	locationOk, e := toolStock.LocationOk(ctx, t, in.GetLocationCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if !locationOk {
+		e = fmt.Errorf("馆编码无效")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 保存入库
+	e = toolStock.Change(ctx, t, in.GetCode(), in.GetLocationCode(), diffCount, 0)
+	if e == toolStock.ErrCount {
+		return nil, status.Errorf(codes.InvalidArgument, "%s库存数量不能小于借出数量", in.GetLocationCode())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 记录库存调整
+	in.Count = diffCount
+	in.TotalCount = newTotalCount
+	e = addStockAdjust(ctx, t, in)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &book.Empty{}, nil
+}
+
+func (s *server) SearchStockAdjust(ctx context.Context, in *book.SearchStockAdjustRequest) (*book.SearchStockAdjustResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'code' = '%s'`, sqlWhere, in.GetCode())
+	}
+	if in.GetType() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'type' = '%s'`, sqlWhere, in.GetType())
+	}
+	if in.GetLocationCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'location_code' = '%s'`, sqlWhere, in.GetLocationCode())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameStockAdjust, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'date_text' desc offset %v limit %v`, toolSql.TableNameStockAdjust, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*book.StockAdjustInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info book.StockAdjustInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := book.SearchStockAdjustResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
+
+func (s *server) Transfer(ctx context.Context, in *book.TransferRequest) (*book.Empty, error) {
+	// 基本校验
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+	in.FromLocationCode = toolStock.LocationCode(in.GetFromLocationCode())
+	in.ToLocationCode = toolStock.LocationCode(in.GetToLocationCode())
+	if in.GetFromLocationCode() == in.GetToLocationCode() {
+		return nil, status.Errorf(codes.InvalidArgument, "调出馆和调入馆不能相同")
+	}
+	if len(in.GetBarcodes()) == 0 && in.GetCount() < 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "需要副本条码或数量")
+	}
+	if in.GetReason() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要原因")
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定图书
+	var totalCount int32
+	e = t.QueryRow(ctx, fmt.Sprintf(`select coalesce(cast(j->>'total_count' as integer), 0) from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, in.GetCode())).Scan(&totalCount)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.InvalidArgument, "图书编码无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 检查馆
+	locationOk, e := toolStock.LocationOk(ctx, t, in.GetToLocationCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if !locationOk {
+		e = fmt.Errorf("调入馆编码无效")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 登记副本的图书调拨副本
+	var copyCount int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameBookCopy, in.GetCode())).Scan(&copyCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	count := in.GetCount()
+	if copyCount > 0 {
+		// 选择副本
+		barcodes := in.GetBarcodes()
+		if len(barcodes) == 0 {
+			rows, error := t.Query(ctx, fmt.Sprintf(`select j->>'barcode' from %s where j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '在架' order by j->>'barcode' limit %d FOR UPDATE;`, toolSql.TableNameBookCopy, in.GetCode(), in.GetFromLocationCode(), in.GetCount()))
+			if error != nil {
+				e = error
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			for rows.Next() {
+				var barcode string
+				e = rows.Scan(&barcode)
+				if e != nil {
+					rows.Close()
+					return nil, status.Errorf(codes.Internal, e.Error())
+				}
+				barcodes = append(barcodes, barcode)
+			}
+			rows.Close()
+		}
+
+		// 在架副本才能调拨
+		for _, barcode := range barcodes {
+			tag, error := t.Exec(ctx, fmt.Sprintf(`update %s set j = jsonb_set(j, '{location_code}', to_jsonb('%s'::text)) where j->>'barcode' = '%s' and j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '在架';`, toolSql.TableNameBookCopy, in.GetToLocationCode(), barcode, in.GetCode(), in.GetFromLocationCode()))
+			if error != nil {
+				e = error
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			if tag.RowsAffected() == 0 {
+				e = fmt.Errorf(`副本条码无效或不在调出馆架上:%s`, barcode)
+				return nil, status.Errorf(codes.InvalidArgument, e.Error())
+			}
+		}
+		count = int32(len(barcodes))
+		if count == 0 || (len(in.GetBarcodes()) == 0 && count < in.GetCount()) {
+			e = fmt.Errorf("调出馆库存数量不足")
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		}
+
+		e = toolStock.SyncCopy(ctx, t, in.GetCode())
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	} else {
+		if len(in.GetBarcodes()) > 0 {
+			e = fmt.Errorf("图书没有登记副本")
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		}
+
+		// 只能调拨在架数量
+		e = toolStock.Change(ctx, t, in.GetCode(), in.GetFromLocationCode(), -count, 0)
+		if e == toolStock.ErrCount {
+			return nil, status.Errorf(codes.InvalidArgument, "调出馆库存数量不足")
+		} else if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		e = toolStock.Change(ctx, t, in.GetCode(), in.GetToLocationCode(), count, 0)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 记录库存调整
+	e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+		Code:         in.GetCode(),
+		Type:         "调拨",
+		Count:        -count,
+		Reason:       in.GetReason(),
+		TotalCount:   totalCount,
+		LocationCode: in.GetFromLocationCode(),
+	})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	e = addStockAdjust(ctx, t, &book.StockAdjustInfo{
+		Code:         in.GetCode(),
+		Type:         "调拨",
+		Count:        count,
+		Reason:       in.GetReason(),
+		TotalCount:   totalCount,
+		LocationCode: in.GetToLocationCode(),
+	})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &book.Empty{}, nil
+}
+
+func (s *server) SearchStock(ctx context.Context, in *book.SearchStockRequest) (*book.SearchStockResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'code' = '%s'`, sqlWhere, in.GetCode())
+	}
+	if in.GetLocationCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'location_code' = '%s'`, sqlWhere, in.GetLocationCode())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameBookStock, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'code', j->>'location_code' offset %v limit %v`, toolSql.TableNameBookStock, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*book.StockInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info book.StockInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := book.SearchStockResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
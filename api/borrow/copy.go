@@ -0,0 +1,279 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/borrow"
+	"gs/proto/tier"
+	"gs/tool"
+	toolSql "gs/tool/sql"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 设置副本状态和所在馆
+func setCopyState(ctx context.Context, t pgx.Tx, barcode, state, locationCode string) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "%s", "location_code": "%s"}' where j->>'barcode' = '%s';`, toolSql.TableNameBookCopy, state, locationCode, barcode))
+	return e
+}
+
+// 图书是否登记副本
+func hasCopy(ctx context.Context, t pgx.Tx, code string) (bool, error) {
+	var copyCount int
+	e := t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameBookCopy, code)).Scan(&copyCount)
+	if e != nil {
+		return false, e
+	}
+	return copyCount > 0, nil
+}
+
+// 按图书编码和应还日期排序
+func sortBooks(books []*borrow.BookInfo) {
+	sort.SliceStable(books, func(i, j int) bool {
+		if books[i].GetCode() != books[j].GetCode() {
+			return books[i].GetCode() < books[j].GetCode()
+		}
+		return books[i].GetDueDate() < books[j].GetDueDate()
+	})
+}
+
+// 是否同一在借批次(图书编码, 借出馆, 应还日期和续借次数相同)
+func sameLot(a, b *borrow.BookInfo) bool {
+	return a.GetCode() == b.GetCode() && a.GetLocationCode() == b.GetLocationCode() && a.GetDueDate() == b.GetDueDate() && a.GetRenewCount() == b.GetRenewCount()
+}
+
+// 借出图书, 按图书编码汇总
+//
+// 登记副本的图书按数量借出时选择该馆在架副本, 副本置为借出.
+func outBooks(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo, locationCode string) ([]*borrow.BookInfo, error) {
+	resultMap := make(map[string]*borrow.BookInfo)
+	getResult := func(code string) *borrow.BookInfo {
+		info, exists := resultMap[code]
+		if !exists {
+			info = &borrow.BookInfo{Code: code, LocationCode: locationCode}
+			resultMap[code] = info
+		}
+		return info
+	}
+
+	// 按条码
+	for _, barcode := range in.GetBarcodes() {
+		var code, state, copyLocationCode string
+		e := t.QueryRow(ctx, fmt.Sprintf(`select j->>'code', j->>'state', j->>'location_code' from %s where j->>'barcode' = '%s' FOR UPDATE;`, toolSql.TableNameBookCopy, barcode)).Scan(&code, &state, &copyLocationCode)
+		if e == pgx.ErrNoRows {
+			return nil, status.Errorf(codes.InvalidArgument, `副本条码无效:%s`, barcode)
+		} else if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if state != "在架" || copyLocationCode != locationCode {
+			return nil, status.Errorf(codes.InvalidArgument, `副本不在该馆架上:%s`, barcode)
+		}
+
+		e = setCopyState(ctx, t, barcode, "借出", locationCode)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		info := getResult(code)
+		info.Count++
+		info.Barcodes = append(info.Barcodes, barcode)
+	}
+
+	// 按数量
+	for _, bookInfo := range in.GetBooks() {
+		if bookInfo.GetCount() < 1 {
+			return nil, status.Errorf(codes.InvalidArgument, `图书数量无效:%s`, bookInfo.GetCode())
+		}
+
+		copyOk, e := hasCopy(ctx, t, bookInfo.GetCode())
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		info := getResult(bookInfo.GetCode())
+		if !copyOk {
+			info.Count += bookInfo.GetCount()
+			continue
+		}
+
+		// 选择副本
+		rows, e := t.Query(ctx, fmt.Sprintf(`select j->>'barcode' from %s where j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '在架' order by j->>'barcode' limit %d FOR UPDATE;`, toolSql.TableNameBookCopy, bookInfo.GetCode(), locationCode, bookInfo.GetCount()))
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var barcodes []string
+		for rows.Next() {
+			var barcode string
+			e = rows.Scan(&barcode)
+			if e != nil {
+				rows.Close()
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			barcodes = append(barcodes, barcode)
+		}
+		rows.Close()
+		if len(barcodes) < int(bookInfo.GetCount()) {
+			return nil, status.Errorf(codes.InvalidArgument, `图书编码无效或库存数量不足:%s`, bookInfo.GetCode())
+		}
+
+		for _, barcode := range barcodes {
+			e = setCopyState(ctx, t, barcode, "借出", locationCode)
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			info.Count++
+			info.Barcodes = append(info.Barcodes, barcode)
+		}
+	}
+
+	var books []*borrow.BookInfo
+	for _, info := range resultMap {
+		books = append(books, info)
+	}
+	sortBooks(books)
+	return books, nil
+}
+
+// 归还(含遗失和损坏)的副本状态
+func closeCopyState(outInType string) string {
+	switch outInType {
+	case "遗失":
+		return "遗失"
+	case "损坏":
+		return "维修"
+	}
+	return "在架"
+}
+
+// 归还图书, 从用户在借中扣除
+//
+// 返回扣除的图书信息(馆编码为借出馆, 应还日期为在借的应还日期), 按数量归还时优先扣除该馆借出的图书, 其次应还日期早的图书.
+// 登记副本的图书副本置为副本状态(归还为在架), 并移至归还馆.
+func inBooks(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo, locationCode string, userBorrow *borrow.UserBorrow, copyState string) ([]*borrow.BookInfo, error) {
+	var books []*borrow.BookInfo
+	addResult := func(lot *borrow.BookInfo, count int32, barcodes []string) {
+		for _, info := range books {
+			if sameLot(info, lot) {
+				info.Count += count
+				info.Barcodes = append(info.Barcodes, barcodes...)
+				return
+			}
+		}
+		books = append(books, &borrow.BookInfo{Code: lot.GetCode(), Count: count, Barcodes: barcodes, LocationCode: lot.GetLocationCode(), DueDate: lot.GetDueDate(), RenewCount: lot.GetRenewCount()})
+	}
+	var returnBarcodes []string
+
+	// 按条码
+	for _, barcode := range in.GetBarcodes() {
+		var lot *borrow.BookInfo
+		for _, v := range userBorrow.GetBooks() {
+			if tool.ArrayIndex(barcode, v.GetBarcodes()) != -1 {
+				lot = v
+				break
+			}
+		}
+		if lot == nil {
+			return nil, status.Errorf(codes.InvalidArgument, `没有借阅此副本:%s`, barcode)
+		}
+
+		lot.Count--
+		lot.Barcodes = removeBarcodes(lot.GetBarcodes(), []string{barcode})
+		addResult(lot, 1, []string{barcode})
+		returnBarcodes = append(returnBarcodes, barcode)
+	}
+
+	// 按数量
+	for _, bookInfo := range in.GetBooks() {
+		if bookInfo.GetCount() < 1 {
+			return nil, status.Errorf(codes.InvalidArgument, `图书数量无效:%s`, bookInfo.GetCode())
+		}
+
+		// 该馆借出的优先, 其次应还日期早的优先
+		var lots []*borrow.BookInfo
+		for _, v := range userBorrow.GetBooks() {
+			if v.GetCode() == bookInfo.GetCode() && v.GetCount() > 0 {
+				lots = append(lots, v)
+			}
+		}
+		if len(lots) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, `没有借阅此书:%s`, bookInfo.GetCode())
+		}
+		sort.SliceStable(lots, func(i, j int) bool {
+			iLocal := lots[i].GetLocationCode() == locationCode
+			jLocal := lots[j].GetLocationCode() == locationCode
+			if iLocal != jLocal {
+				return iLocal
+			}
+			return lots[i].GetDueDate() < lots[j].GetDueDate()
+		})
+
+		count := bookInfo.GetCount()
+		for _, lot := range lots {
+			if count == 0 {
+				break
+			}
+			takeCount := count
+			if lot.GetCount() < takeCount {
+				takeCount = lot.GetCount()
+			}
+			takeBarcodeCount := int(takeCount)
+			if len(lot.GetBarcodes()) < takeBarcodeCount {
+				takeBarcodeCount = len(lot.GetBarcodes())
+			}
+			barcodes := append([]string{}, lot.GetBarcodes()[:takeBarcodeCount]...)
+			lot.Barcodes = lot.GetBarcodes()[takeBarcodeCount:]
+			lot.Count -= takeCount
+			addResult(lot, takeCount, barcodes)
+			returnBarcodes = append(returnBarcodes, barcodes...)
+			count -= takeCount
+		}
+		if count > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, `归还数量超过借阅:%s`, bookInfo.GetCode())
+		}
+	}
+
+	// 移除已经全部归还的在借
+	removeEmptyLots(userBorrow)
+
+	// 副本归还到该馆
+	for _, barcode := range returnBarcodes {
+		e := setCopyState(ctx, t, barcode, copyState, locationCode)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	sortBooks(books)
+	return books, nil
+}
+
+// 移除条码
+func removeBarcodes(barcodes []string, removeArray []string) []string {
+	var result []string
+	for _, v := range barcodes {
+		if tool.ArrayIndex(v, removeArray) == -1 {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// 检查在借图书是否超过会员等级的最多在借数量和每种图书最多在借数量
+func checkTierLimit(tierInfo *tier.Info, books []*borrow.BookInfo) error {
+	var total int32
+	titleMap := map[string]int32{}
+	for _, bookInfo := range books {
+		total += bookInfo.GetCount()
+		titleMap[bookInfo.GetCode()] += bookInfo.GetCount()
+	}
+	if total > tierInfo.GetMaxLoanCount() {
+		return fmt.Errorf(`超过会员等级%s最多在借数量:%d`, tierInfo.GetCode(), tierInfo.GetMaxLoanCount())
+	}
+	for _, bookInfo := range books {
+		if titleMap[bookInfo.GetCode()] > tierInfo.GetMaxTitleCount() {
+			return fmt.Errorf(`超过会员等级%s每种图书最多在借数量%d:%s`, tierInfo.GetCode(), tierInfo.GetMaxTitleCount(), bookInfo.GetCode())
+		}
+	}
+	return nil
+}
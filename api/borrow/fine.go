@@ -0,0 +1,108 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/borrow"
+	"gs/proto/fine"
+	"gs/proto/tier"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// 逾期天数, 没有应还日期或没有逾期时为0
+func overdueDays(dueDate string, now time.Time) int32 {
+	due, e := time.ParseInLocation("2006-01-02", dueDate, time.Local)
+	if e != nil {
+		return 0
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	days := int32(today.Sub(due).Hours() / 24)
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+// 每本罚款金额, 不超过会员等级的罚款上限
+func fineAmount(tierInfo *tier.Info, days int32) int32 {
+	amount := tierInfo.GetFinePerDay() * days
+	if tierInfo.GetFineCap() > 0 && amount > tierInfo.GetFineCap() {
+		amount = tierInfo.GetFineCap()
+	}
+	return amount
+}
+
+// 逾期归还的图书记录罚款
+func addFines(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo, tierInfo *tier.Info) error {
+	now := time.Now()
+	for _, bookInfo := range in.GetBooks() {
+		days := overdueDays(bookInfo.GetDueDate(), now)
+		amount := fineAmount(tierInfo, days) * bookInfo.GetCount()
+		if amount <= 0 {
+			continue
+		}
+
+		info := fine.Info{
+			Id:          uuid.New().String(),
+			DateText:    in.GetDateText(),
+			Username:    in.GetUsername(),
+			Code:        bookInfo.GetCode(),
+			Count:       bookInfo.GetCount(),
+			Barcodes:    bookInfo.GetBarcodes(),
+			DueDate:     bookInfo.GetDueDate(),
+			ReturnDate:  now.Format("2006-01-02"),
+			OverdueDays: days,
+			Amount:      amount,
+			State:       "未付",
+			OutinId:     in.GetId(),
+			Type:        "逾期",
+		}
+		infoText, _ := toolApi.ProtoToJson(&info)
+		_, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameFine, infoText))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// 遗失和损坏的图书记录赔偿
+func addReplacementFines(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo) error {
+	if in.GetReplacementAmount() <= 0 {
+		return nil
+	}
+	for _, bookInfo := range in.GetBooks() {
+		info := fine.Info{
+			Id:         uuid.New().String(),
+			DateText:   in.GetDateText(),
+			Username:   in.GetUsername(),
+			Code:       bookInfo.GetCode(),
+			Count:      bookInfo.GetCount(),
+			Barcodes:   bookInfo.GetBarcodes(),
+			DueDate:    bookInfo.GetDueDate(),
+			ReturnDate: in.GetDateText()[:10],
+			Amount:     in.GetReplacementAmount() * bookInfo.GetCount(),
+			State:      "未付",
+			OutinId:    in.GetId(),
+			Type:       "赔偿",
+		}
+		infoText, _ := toolApi.ProtoToJson(&info)
+		_, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameFine, infoText))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// 用户未付罚款金额
+func unpaidFineAmount(ctx context.Context, t pgx.Tx, username string) (int32, error) {
+	var amount int32
+	e := t.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(j->>'amount' as integer) - cast(j->>'paid_amount' as integer)), 0) from %s where j->>'username' = '%s' and j->>'state' = '未付'`, toolSql.TableNameFine, username)).Scan(&amount)
+	return amount, e
+}
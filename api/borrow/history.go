@@ -0,0 +1,93 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/borrow"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *server) History(ctx context.Context, in *borrow.HistoryRequest) (*borrow.HistoryResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	if in.GetType() != "" && tool.ArrayIndex(in.GetType(), []string{"借出", "归还", "续借", "遗失", "损坏"}) == -1 {
+		return nil, status.Errorf(codes.InvalidArgument, "类型无效")
+	}
+	for _, date := range []string{in.GetDateStart(), in.GetDateEnd()} {
+		if date == "" {
+			continue
+		}
+		_, e := time.Parse("2006-01-02", date)
+		if e != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "日期无效:%s", date)
+		}
+	}
+
+	// 读者只能查询自己的记录
+	username := in.GetUsername()
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) == toolRole.Reader {
+		username = ctx.Value(toolApi.ContextKeyUserId).(string)
+	}
+
+	sqlWhere := `1 = 1`
+	if username != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'username' = '%s'`, sqlWhere, username)
+	}
+	if in.GetOperator() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'operator' = '%s'`, sqlWhere, in.GetOperator())
+	}
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->'books' @> '[{"code": "%s"}]'`, sqlWhere, in.GetCode())
+	}
+	if in.GetType() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'type' = '%s'`, sqlWhere, in.GetType())
+	}
+	if in.GetDateStart() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'date_text' >= '%s'`, sqlWhere, in.GetDateStart())
+	}
+	if in.GetDateEnd() != "" {
+		// 包含结束日期当天
+		dateEnd, _ := time.Parse("2006-01-02", in.GetDateEnd())
+		sqlWhere = fmt.Sprintf(`%s and j->>'date_text' < '%s'`, sqlWhere, dateEnd.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameBorrowOutIn, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'date_text' desc, j->>'id' offset %v limit %v`, toolSql.TableNameBorrowOutIn, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var infoArray []*borrow.OutInInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info borrow.OutInInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := borrow.HistoryResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
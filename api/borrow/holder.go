@@ -0,0 +1,35 @@
+package borrow
+
+import (
+	"context"
+	"gs/proto/book"
+	"gs/proto/borrow"
+	toolApi "gs/tool/api"
+	toolHolder "gs/tool/holder"
+	toolRole "gs/tool/role"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *server) Holders(ctx context.Context, in *borrow.HoldersRequest) (*borrow.HoldersResponse, error) {
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+	// 在借用户仅馆员可见, 同图书详情
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+		return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以查询在借用户")
+	}
+
+	holders, e := toolHolder.Holders(ctx, sdb, in.GetCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	var result borrow.HoldersResponse
+	for _, v := range holders {
+		result.Count += v.Count
+		result.InfoArray = append(result.InfoArray, &book.HolderInfo{Username: v.Username, Count: v.Count, DueDate: v.DueDate})
+	}
+	return &result, nil
+}
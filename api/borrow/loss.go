@@ -0,0 +1,48 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/book"
+	"gs/proto/borrow"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// 遗失和损坏的图书记录库存调整
+//
+// 在库存更新后调用, 登记副本的图书库存已由副本状态重新计算, 同样记录调整和副本条码
+func addLossAdjusts(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo) error {
+	for _, bookInfo := range in.GetBooks() {
+		var totalCount int32
+		e := t.QueryRow(ctx, fmt.Sprintf(`select coalesce(cast(j->>'total_count' as integer), 0) from %s where j->>'code' = '%s'`, toolSql.TableNameBook, bookInfo.GetCode())).Scan(&totalCount)
+		if e != nil {
+			return e
+		}
+
+		info := book.StockAdjustInfo{
+			Id:           uuid.New().String(),
+			DateText:     in.GetDateText(),
+			Username:     in.GetOperator(),
+			Code:         bookInfo.GetCode(),
+			Type:         in.GetType(),
+			Count:        -bookInfo.GetCount(),
+			Reason:       fmt.Sprintf("读者%s借还记录:%s", in.GetUsername(), in.GetId()),
+			TotalCount:   totalCount,
+			LocationCode: bookInfo.GetLocationCode(),
+		}
+		if len(bookInfo.GetBarcodes()) > 0 {
+			info.Reason = fmt.Sprintf("%s, 副本条码:%s", info.GetReason(), strings.Join(bookInfo.GetBarcodes(), ","))
+		}
+		infoText, _ := toolApi.ProtoToJson(&info)
+		_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameStockAdjust, infoText))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/borrow"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 合并请求中重复的图书编码和副本条码, 并排序
+func mergeRequestBooks(in *borrow.OutInInfo) error {
+	var books []*borrow.BookInfo
+	bookMap := make(map[string]*borrow.BookInfo)
+	for _, bookInfo := range in.GetBooks() {
+		if bookInfo.GetCount() < 1 {
+			return status.Errorf(codes.InvalidArgument, `图书数量无效:%s`, bookInfo.GetCode())
+		}
+		info, exists := bookMap[bookInfo.GetCode()]
+		if !exists {
+			info = &borrow.BookInfo{Code: bookInfo.GetCode()}
+			bookMap[bookInfo.GetCode()] = info
+			books = append(books, info)
+		}
+		info.Count += bookInfo.GetCount()
+	}
+	sortBooks(books)
+	in.Books = books
+
+	var barcodes []string
+	for _, barcode := range in.GetBarcodes() {
+		if tool.ArrayIndex(barcode, barcodes) == -1 {
+			barcodes = append(barcodes, barcode)
+		}
+	}
+	sort.Strings(barcodes)
+	in.Barcodes = barcodes
+	return nil
+}
+
+// 按图书编码顺序锁定请求涉及的图书(包括副本条码所属的图书)
+//
+// 借还相关的事务都先锁定图书, 再修改副本, 在馆库存和用户在借, 并发请求按相同顺序加锁, 不会死锁
+func lockBooks(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo) error {
+	var codeArray []string
+	for _, bookInfo := range in.GetBooks() {
+		codeArray = append(codeArray, fmt.Sprintf(`'%s'`, bookInfo.GetCode()))
+	}
+	for _, barcode := range in.GetBarcodes() {
+		codeArray = append(codeArray, fmt.Sprintf(`(select j->>'code' from %s where j->>'barcode' = '%s')`, toolSql.TableNameBookCopy, barcode))
+	}
+	if len(codeArray) == 0 {
+		return nil
+	}
+
+	_, e := t.Exec(ctx, fmt.Sprintf(`select 1 from %s where j->>'code' in (%s) order by j->>'code' FOR UPDATE;`, toolSql.TableNameBook, strings.Join(codeArray, ",")))
+	return e
+}
+
+// 查询读者, 按用户名或借书证号, 读者必须是正常状态
+//
+// 返回读者用户名, 错误为grpc状态
+func getReader(ctx context.Context, t pgx.Tx, username, cardNumber string) (string, error) {
+	sqlWhere := `1 = 1`
+	if username != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'username' = '%s'`, sqlWhere, username)
+	}
+	if cardNumber != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'card_number' = '%s'`, sqlWhere, cardNumber)
+	}
+
+	var readerUsername, readerState string
+	e := t.QueryRow(ctx, fmt.Sprintf(`select j->>'username', j->>'state' from %s where %s FOR SHARE;`, toolSql.TableNameUser, sqlWhere)).Scan(&readerUsername, &readerState)
+	if e == pgx.ErrNoRows {
+		return "", status.Errorf(codes.InvalidArgument, "读者用户名或借书证号无效")
+	} else if e != nil {
+		return "", status.Errorf(codes.Internal, e.Error())
+	}
+	if readerState != "正常" {
+		return "", status.Errorf(codes.FailedPrecondition, "读者状态为%s, 不能借还", readerState)
+	}
+	return readerUsername, nil
+}
+
+// 查询并锁定用户在借, 没有在借时返回空的用户在借
+func getUserBorrow(ctx context.Context, t pgx.Tx, username string) (*borrow.UserBorrow, error) {
+	userBorrow := borrow.UserBorrow{Username: username}
+	var jsonText string
+	e := t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'username' = '%s' FOR UPDATE;`, toolSql.TableNameUserBorrow, username)).Scan(&jsonText)
+	if e == pgx.ErrNoRows {
+		return &userBorrow, nil
+	} else if e != nil {
+		return nil, e
+	}
+	e = toolApi.JsonToProto(jsonText, &userBorrow)
+	if e != nil {
+		return nil, e
+	}
+	for _, bookInfo := range userBorrow.GetBooks() {
+		bookInfo.LocationCode = toolStock.LocationCode(bookInfo.GetLocationCode())
+	}
+	return &userBorrow, nil
+}
+
+// 合并到用户在借, 同一批次时累加数量和条码
+func mergeLot(userBorrow *borrow.UserBorrow, bookInfo *borrow.BookInfo) {
+	for _, v := range userBorrow.GetBooks() {
+		if sameLot(v, bookInfo) {
+			v.Count += bookInfo.GetCount()
+			v.Barcodes = append(v.Barcodes, bookInfo.GetBarcodes()...)
+			return
+		}
+	}
+	userBorrow.Books = append(userBorrow.Books, &borrow.BookInfo{Code: bookInfo.GetCode(), Count: bookInfo.GetCount(), Barcodes: bookInfo.GetBarcodes(), LocationCode: bookInfo.GetLocationCode(), DueDate: bookInfo.GetDueDate(), RenewCount: bookInfo.GetRenewCount()})
+}
+
+// 移除已经全部归还的在借
+func removeEmptyLots(userBorrow *borrow.UserBorrow) {
+	var lots []*borrow.BookInfo
+	for _, v := range userBorrow.GetBooks() {
+		if v.GetCount() > 0 {
+			lots = append(lots, v)
+		}
+	}
+	userBorrow.Books = lots
+}
+
+// 保存用户在借, 没有在借时删除
+func saveUserBorrow(ctx context.Context, t pgx.Tx, userBorrow *borrow.UserBorrow) error {
+	books := userBorrow.GetBooks()
+	sortBooks(books)
+	if len(books) == 0 {
+		_, e := t.Exec(ctx, fmt.Sprintf(`delete from %s where j->>'username' = '%s';`, toolSql.TableNameUserBorrow, userBorrow.GetUsername()))
+		return e
+	}
+
+	jsonText, _ := toolApi.ProtoToJson(&borrow.UserBorrow{Username: userBorrow.GetUsername(), Books: books})
+	tag, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s') ON CONFLICT ((j->'username')) DO UPDATE SET j = EXCLUDED.j;`, toolSql.TableNameUserBorrow, jsonText))
+	if e != nil {
+		return e
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf(`用户在借没有保存`)
+	}
+	return nil
+}
+
+// 保存借还记录
+func addOutIn(ctx context.Context, t pgx.Tx, in *borrow.OutInInfo) error {
+	inText, _ := toolApi.ProtoToJson(in)
+	tag, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameBorrowOutIn, inText))
+	if e != nil {
+		return e
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf(`借还记录没有保存`)
+	}
+	return nil
+}
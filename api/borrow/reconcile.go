@@ -0,0 +1,333 @@
+package borrow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/borrow"
+	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 对账数量, 键为 用户名|图书编码|馆编码 或 图书编码|馆编码 或 图书编码
+type countMap map[string]int32
+
+func (m countMap) keys() []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// 查询数量
+func queryCounts(ctx context.Context, t pgx.Tx, sql string, keyCount int) (countMap, error) {
+	rows, e := t.Query(ctx, sql)
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	result := countMap{}
+	for rows.Next() {
+		keys := make([]string, keyCount)
+		var count int32
+		dest := make([]any, keyCount+1)
+		for i := range keys {
+			dest[i] = &keys[i]
+		}
+		dest[keyCount] = &count
+		e = rows.Scan(dest...)
+		if e != nil {
+			return nil, e
+		}
+		result[strings.Join(keys, "|")] += count
+	}
+	return result, rows.Err()
+}
+
+// 比较数量, 返回不一致
+func compareCounts(discrepancyType string, expected, actual countMap) []*borrow.DiscrepancyInfo {
+	keyMap := map[string]bool{}
+	for _, k := range append(expected.keys(), actual.keys()...) {
+		keyMap[k] = true
+	}
+
+	var result []*borrow.DiscrepancyInfo
+	for k := range keyMap {
+		if expected[k] == actual[k] {
+			continue
+		}
+		info := borrow.DiscrepancyInfo{Type: discrepancyType, ExpectedCount: expected[k], ActualCount: actual[k]}
+		keys := strings.Split(k, "|")
+		switch len(keys) {
+		case 3:
+			info.Username, info.Code, info.LocationCode = keys[0], keys[1], keys[2]
+		case 2:
+			info.Code, info.LocationCode = keys[0], keys[1]
+		default:
+			info.Code = keys[0]
+		}
+		result = append(result, &info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.GetUsername() != b.GetUsername() {
+			return a.GetUsername() < b.GetUsername()
+		}
+		if a.GetCode() != b.GetCode() {
+			return a.GetCode() < b.GetCode()
+		}
+		return a.GetLocationCode() < b.GetLocationCode()
+	})
+	return result
+}
+
+// 修复用户在借: 少记时按最近借出的应还日期补记, 多记时先扣除应还日期晚的
+//
+// 只修复没有登记副本的图书, 在借没有副本条码
+func repairUserBorrow(ctx context.Context, t pgx.Tx, infoArray []*borrow.DiscrepancyInfo, dueDateMap map[string]string) error {
+	usernameMap := map[string][]*borrow.DiscrepancyInfo{}
+	var usernames []string
+	for _, info := range infoArray {
+		if _, exists := usernameMap[info.GetUsername()]; !exists {
+			usernames = append(usernames, info.GetUsername())
+		}
+		usernameMap[info.GetUsername()] = append(usernameMap[info.GetUsername()], info)
+	}
+
+	for _, username := range usernames {
+		userBorrow, e := getUserBorrow(ctx, t, username)
+		if e != nil {
+			return e
+		}
+		for _, info := range usernameMap[username] {
+			diff := info.GetExpectedCount() - info.GetActualCount()
+			if diff > 0 {
+				mergeLot(userBorrow, &borrow.BookInfo{
+					Code:         info.GetCode(),
+					Count:        diff,
+					LocationCode: info.GetLocationCode(),
+					DueDate:      dueDateMap[strings.Join([]string{username, info.GetCode(), info.GetLocationCode()}, "|")],
+				})
+				continue
+			}
+
+			var lots []*borrow.BookInfo
+			for _, v := range userBorrow.GetBooks() {
+				if v.GetCode() == info.GetCode() && v.GetLocationCode() == info.GetLocationCode() {
+					lots = append(lots, v)
+				}
+			}
+			sort.SliceStable(lots, func(i, j int) bool {
+				return lots[i].GetDueDate() > lots[j].GetDueDate()
+			})
+			count := -diff
+			for _, lot := range lots {
+				if count == 0 {
+					break
+				}
+				takeCount := count
+				if lot.GetCount() < takeCount {
+					takeCount = lot.GetCount()
+				}
+				lot.Count -= takeCount
+				count -= takeCount
+			}
+		}
+		removeEmptyLots(userBorrow)
+		e = saveUserBorrow(ctx, t, userBorrow)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// 对账结果
+type reconcileCounts struct {
+	userArray  []*borrow.DiscrepancyInfo
+	stockArray []*borrow.DiscrepancyInfo
+	bookArray  []*borrow.DiscrepancyInfo
+	// 最近借出或续借的应还日期, 键为 用户名|图书编码|馆编码
+	dueDateMap map[string]string
+}
+
+func (c *reconcileCounts) infoArray() []*borrow.DiscrepancyInfo {
+	return append(append(append([]*borrow.DiscrepancyInfo{}, c.userArray...), c.stockArray...), c.bookArray...)
+}
+
+// 根据借还记录计算并比较用户在借, 在馆借出和图书借出
+func compareReconcile(ctx context.Context, t pgx.Tx) (*reconcileCounts, error) {
+	// 根据借还记录计算用户在借, 续借不改变数量
+	sqlLog := fmt.Sprintf(`select o.j->>'username', b->>'code', coalesce(nullif(b->>'location_code', ''), '%s') as location_code,
+case when o.j->>'type' = '借出' then 1 when o.j->>'type' in ('归还', '遗失', '损坏') then -1 else 0 end * cast(b->>'count' as integer) as count,
+case when o.j->>'type' in ('借出', '续借') then coalesce(b->>'due_date', '') else '' end as due_date
+from %s as o, jsonb_array_elements(o.j->'books') as b`, toolSql.DefaultLocationCode, toolSql.TableNameBorrowOutIn)
+	expectedUser, e := queryCounts(ctx, t, fmt.Sprintf(`select username, code, location_code, greatest(sum(count), 0) from (%s) as l(username, code, location_code, count, due_date) group by 1, 2, 3`, sqlLog), 3)
+	if e != nil {
+		return nil, e
+	}
+	for k, v := range expectedUser {
+		if v == 0 {
+			delete(expectedUser, k)
+		}
+	}
+	dueDateMap := map[string]string{}
+	rows, e := t.Query(ctx, fmt.Sprintf(`select username, code, location_code, max(due_date) from (%s) as l(username, code, location_code, count, due_date) group by 1, 2, 3`, sqlLog))
+	if e != nil {
+		return nil, e
+	}
+	for rows.Next() {
+		var username, code, locationCode, dueDate string
+		e = rows.Scan(&username, &code, &locationCode, &dueDate)
+		if e != nil {
+			rows.Close()
+			return nil, e
+		}
+		dueDateMap[strings.Join([]string{username, code, locationCode}, "|")] = dueDate
+	}
+	rows.Close()
+
+	// 当前记录的用户在借, 在馆借出和图书借出
+	actualUser, e := queryCounts(ctx, t, fmt.Sprintf(`select u.j->>'username', b->>'code', coalesce(nullif(b->>'location_code', ''), '%s'), sum(cast(b->>'count' as integer))
+from %s as u, jsonb_array_elements(u.j->'books') as b group by 1, 2, 3`, toolSql.DefaultLocationCode, toolSql.TableNameUserBorrow), 3)
+	if e != nil {
+		return nil, e
+	}
+	actualStock, e := queryCounts(ctx, t, fmt.Sprintf(`select j->>'code', j->>'location_code', cast(j->>'borrow_count' as integer) from %s where cast(j->>'borrow_count' as integer) != 0`, toolSql.TableNameBookStock), 2)
+	if e != nil {
+		return nil, e
+	}
+	actualBook, e := queryCounts(ctx, t, fmt.Sprintf(`select j->>'code', coalesce(cast(j->>'borrow_count' as integer), 0) from %s where coalesce(cast(j->>'borrow_count' as integer), 0) != 0`, toolSql.TableNameBook), 1)
+	if e != nil {
+		return nil, e
+	}
+
+	// 在馆借出和图书借出为用户在借之和
+	expectedStock := countMap{}
+	expectedBook := countMap{}
+	for k, v := range expectedUser {
+		keys := strings.Split(k, "|")
+		expectedStock[strings.Join(keys[1:], "|")] += v
+		expectedBook[keys[1]] += v
+	}
+
+	return &reconcileCounts{
+		userArray:  compareCounts("用户在借", expectedUser, actualUser),
+		stockArray: compareCounts("在馆借出", expectedStock, actualStock),
+		bookArray:  compareCounts("图书借出", expectedBook, actualBook),
+		dueDateMap: dueDateMap,
+	}, nil
+}
+
+// 登记副本的图书不一致, 副本状态需要人工核对, 不能按数量修复
+var errCopy = errors.New("登记副本的图书不能按数量修复")
+
+// Reconcile 对账, 根据借还记录重新计算用户在借和在馆借出数量, 返回不一致
+//
+// 修复时锁定全部图书(与借还相同的图书编码顺序), 在同一事务中更正用户在借和库存,
+// 修复后重新对账, 仍有不一致时回滚. 登记副本的图书需要核对副本状态, 不按数量修复.
+func Reconcile(ctx context.Context, repair bool) (*borrow.ReconcileResponse, error) {
+	db := toolSql.GetDb()
+
+	// 准备事务: 只对账时使用一致的快照
+	txOptions := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+	if repair {
+		txOptions = pgx.TxOptions{}
+	}
+	t, e := db.BeginTx(ctx, txOptions)
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	if repair {
+		_, e = t.Exec(ctx, fmt.Sprintf(`select 1 from %s order by j->>'code' FOR UPDATE;`, toolSql.TableNameBook))
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	counts, e := compareReconcile(ctx, t)
+	if e != nil {
+		return nil, e
+	}
+	var result borrow.ReconcileResponse
+	result.InfoArray = counts.infoArray()
+	if !repair || len(result.InfoArray) == 0 {
+		return &result, nil
+	}
+
+	// 登记副本的图书在借和副本状态需要一起核对, 不修复
+	for _, info := range append(append([]*borrow.DiscrepancyInfo{}, counts.userArray...), counts.stockArray...) {
+		copyOk, error := hasCopy(ctx, t, info.GetCode())
+		if error != nil {
+			e = error
+			return nil, e
+		}
+		if copyOk {
+			e = fmt.Errorf("%w, 请核对副本状态:%s", errCopy, info.GetCode())
+			return nil, e
+		}
+	}
+
+	// 修复
+	e = repairUserBorrow(ctx, t, counts.userArray, counts.dueDateMap)
+	if e != nil {
+		return nil, e
+	}
+	for _, info := range counts.stockArray {
+		e = toolStock.SetBorrowCount(ctx, t, info.GetCode(), info.GetLocationCode(), info.GetExpectedCount())
+		if e == toolStock.ErrCount {
+			// 借还记录的在借超过在馆库存, 需要先调整库存
+			e = fmt.Errorf("%w, 在借%d超过在馆库存, 请先调整库存:%s %s", toolStock.ErrCount, info.GetExpectedCount(), info.GetCode(), info.GetLocationCode())
+			return nil, e
+		} else if e != nil {
+			return nil, e
+		}
+	}
+	for _, info := range counts.bookArray {
+		e = toolStock.Sync(ctx, t, info.GetCode())
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	// 修复后重新对账, 仍有不一致时回滚
+	repaired, e := compareReconcile(ctx, t)
+	if e != nil {
+		return nil, e
+	}
+	if infoArray := repaired.infoArray(); len(infoArray) > 0 {
+		e = fmt.Errorf("修复后仍有%d处不一致", len(infoArray))
+		return nil, e
+	}
+	result.Repaired = true
+	return &result, nil
+}
+
+func (s *server) Reconcile(ctx context.Context, in *borrow.ReconcileRequest) (*borrow.ReconcileResponse, error) {
+	result, e := Reconcile(ctx, in.GetRepair())
+	if errors.Is(e, toolStock.ErrCount) || errors.Is(e, errCopy) {
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	return result, nil
+}
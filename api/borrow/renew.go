@@ -0,0 +1,171 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/borrow"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	toolTier "gs/tool/tier"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *server) Renew(ctx context.Context, in *borrow.RenewRequest) (*borrow.UserBorrow, error) {
+	// 基本检查
+	if len(in.GetCodes()) == 0 && len(in.GetBarcodes()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码或副本条码")
+	}
+
+	// 序列化失败或死锁时重试
+	var result *borrow.UserBorrow
+	e := toolSql.Retry(ctx, func() error {
+		r, e := renew(ctx, in)
+		result = r
+		return e
+	})
+	return result, e
+}
+
+// 续借事务
+func renew(ctx context.Context, in *borrow.RenewRequest) (*borrow.UserBorrow, error) {
+
+	// 上下文中获取用户名
+	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 按图书编码顺序锁定图书, 避免和预约并发
+	var lockBookArray []*borrow.BookInfo
+	for _, code := range in.GetCodes() {
+		lockBookArray = append(lockBookArray, &borrow.BookInfo{Code: code})
+	}
+	e = lockBooks(ctx, t, &borrow.OutInInfo{Books: lockBookArray, Barcodes: in.GetBarcodes()})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 查询会员等级
+	tierInfo, e := toolTier.UserTier(ctx, t, username)
+	if e == pgx.ErrNoRows {
+		e = fmt.Errorf("用户名或会员等级无效")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 查询用户在借
+	userBorrow, e := getUserBorrow(ctx, t, username)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 按条码拆出副本, 按编码取出全部在借
+	var books []*borrow.BookInfo
+	for _, barcode := range in.GetBarcodes() {
+		var lot *borrow.BookInfo
+		for _, v := range userBorrow.GetBooks() {
+			if tool.ArrayIndex(barcode, v.GetBarcodes()) != -1 {
+				lot = v
+				break
+			}
+		}
+		if lot == nil {
+			e = fmt.Errorf(`没有借阅此副本:%s`, barcode)
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		}
+
+		lot.Count--
+		lot.Barcodes = removeBarcodes(lot.GetBarcodes(), []string{barcode})
+		books = append(books, &borrow.BookInfo{Code: lot.GetCode(), Count: 1, Barcodes: []string{barcode}, LocationCode: lot.GetLocationCode(), DueDate: lot.GetDueDate(), RenewCount: lot.GetRenewCount()})
+	}
+	for _, code := range in.GetCodes() {
+		found := false
+		for _, lot := range userBorrow.GetBooks() {
+			if lot.GetCode() != code || lot.GetCount() == 0 {
+				continue
+			}
+			found = true
+			books = append(books, &borrow.BookInfo{Code: lot.GetCode(), Count: lot.GetCount(), Barcodes: lot.GetBarcodes(), LocationCode: lot.GetLocationCode(), DueDate: lot.GetDueDate(), RenewCount: lot.GetRenewCount()})
+			lot.Count = 0
+			lot.Barcodes = nil
+		}
+		if !found {
+			e = fmt.Errorf(`没有借阅此书:%s`, code)
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		}
+	}
+	removeEmptyLots(userBorrow)
+
+	// 检查并延长应还日期, 从应还日期和今天中较晚的一天开始计算, 提前续借不损失剩余借期
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	for _, bookInfo := range books {
+		if bookInfo.GetDueDate() != "" && bookInfo.GetDueDate() < today {
+			e = fmt.Errorf(`已逾期, 不能续借:%s`, bookInfo.GetCode())
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+		if bookInfo.GetRenewCount() >= tierInfo.GetMaxRenewCount() {
+			e = fmt.Errorf(`超过会员等级%s最多续借次数%d:%s`, tierInfo.GetCode(), tierInfo.GetMaxRenewCount(), bookInfo.GetCode())
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+		reserved, error := reservedByOther(ctx, t, username, bookInfo.GetCode())
+		if error != nil {
+			e = error
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if reserved {
+			e = fmt.Errorf(`其他读者已预约, 不能续借:%s`, bookInfo.GetCode())
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+
+		startDate := now
+		if bookInfo.GetDueDate() > today {
+			startDate, _ = time.ParseInLocation("2006-01-02", bookInfo.GetDueDate(), time.Local)
+		}
+		bookInfo.DueDate = startDate.AddDate(0, 0, int(tierInfo.GetLoanDays())).Format("2006-01-02")
+		bookInfo.RenewCount++
+		mergeLot(userBorrow, bookInfo)
+	}
+
+	// 更新用户在借
+	e = saveUserBorrow(ctx, t, userBorrow)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 保存续借记录
+	sortBooks(books)
+	e = addOutIn(ctx, t, &borrow.OutInInfo{
+		Id:       uuid.New().String(),
+		DateText: now.Format("2006-01-02T15:04:05"),
+		Username: username,
+		Type:     "续借",
+		Books:    books,
+	})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	sortBooks(userBorrow.Books)
+	return userBorrow, nil
+}
@@ -0,0 +1,340 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/borrow"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	"gs/tool/env"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 在馆可借数量(库存数量-借出数量-待取预约)
+func availableCount(ctx context.Context, t pgx.Tx, code, locationCode string) (int32, error) {
+	var count int32
+	e := t.QueryRow(ctx, fmt.Sprintf(`select
+coalesce((select cast(j->>'total_count' as integer) - cast(j->>'borrow_count' as integer) from %s where j->>'code' = '%s' and j->>'location_code' = '%s'), 0)
+- (select count(*) from %s where j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '待取')`,
+		toolSql.TableNameBookStock, code, locationCode, toolSql.TableNameReservation, code, locationCode)).Scan(&count)
+	return count, e
+}
+
+// 刷新图书预约: 待取超过保留期限的过期, 可借库存按预约顺序保留给排队的读者
+func refreshHolds(ctx context.Context, t pgx.Tx, code string) error {
+	now := time.Now()
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "过期"}' where j->>'code' = '%s' and j->>'state' = '待取' and j->>'pickup_deadline' < '%s';`,
+		toolSql.TableNameReservation, code, now.Format("2006-01-02T15:04:05")))
+	if e != nil {
+		return e
+	}
+
+	// 有排队的馆
+	rows, e := t.Query(ctx, fmt.Sprintf(`select distinct j->>'location_code' from %s where j->>'code' = '%s' and j->>'state' = '排队'`, toolSql.TableNameReservation, code))
+	if e != nil {
+		return e
+	}
+	var locationCodes []string
+	for rows.Next() {
+		var locationCode string
+		e = rows.Scan(&locationCode)
+		if e != nil {
+			rows.Close()
+			return e
+		}
+		locationCodes = append(locationCodes, locationCode)
+	}
+	rows.Close()
+
+	pickupDays, _ := strconv.Atoi(env.HoldPickupDays)
+	pickupDeadline := now.AddDate(0, 0, pickupDays).Format("2006-01-02T15:04:05")
+	for _, locationCode := range locationCodes {
+		count, e := availableCount(ctx, t, code, locationCode)
+		if e != nil {
+			return e
+		}
+		if count <= 0 {
+			continue
+		}
+
+		_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "待取", "pickup_deadline": "%s"}' where j->>'id' in (
+select j->>'id' from %s where j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '排队' order by j->>'date_text', j->>'id' limit %d FOR UPDATE
+);`, toolSql.TableNameReservation, pickupDeadline, toolSql.TableNameReservation, code, locationCode, count))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// 借出时完成读者自己的预约(先待取, 后排队)
+func fulfillHolds(ctx context.Context, t pgx.Tx, username, code, locationCode string, count int32) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "已借"}' where j->>'id' in (
+select j->>'id' from %s where j->>'username' = '%s' and j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' in ('待取', '排队') order by case when j->>'state' = '待取' then 0 else 1 end, j->>'date_text' limit %d FOR UPDATE
+);`, toolSql.TableNameReservation, toolSql.TableNameReservation, username, code, locationCode, count))
+	return e
+}
+
+// 其他读者是否预约
+func reservedByOther(ctx context.Context, t pgx.Tx, username, code string) (bool, error) {
+	var count int
+	e := t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s' and j->>'username' != '%s' and j->>'state' in ('排队', '待取')`, toolSql.TableNameReservation, code, username)).Scan(&count)
+	return count > 0, e
+}
+
+// 排队位置, 不在排队时为0
+func queuePosition(ctx context.Context, q toolSql.Querier, info *borrow.ReserveInfo) (int32, error) {
+	if info.GetState() != "排队" {
+		return 0, nil
+	}
+	var position int32
+	e := q.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s' and j->>'location_code' = '%s' and j->>'state' = '排队' and (j->>'date_text', j->>'id') <= ('%s', '%s')`,
+		toolSql.TableNameReservation, info.GetCode(), info.GetLocationCode(), info.GetDateText(), info.GetId())).Scan(&position)
+	return position, e
+}
+
+// 查询并锁定预约
+func getReserveInfo(ctx context.Context, t pgx.Tx, id string) (*borrow.ReserveInfo, error) {
+	var jsonText string
+	e := t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'id' = '%s' FOR UPDATE;`, toolSql.TableNameReservation, id)).Scan(&jsonText)
+	if e != nil {
+		return nil, e
+	}
+	var info borrow.ReserveInfo
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, e
+	}
+	return &info, nil
+}
+
+func (s *server) Reserve(ctx context.Context, in *borrow.ReserveRequest) (*borrow.ReserveInfo, error) {
+	// 基本检查
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+	locationCode := toolStock.LocationCode(in.GetLocationCode())
+
+	// 上下文中获取用户名
+	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 检查馆
+	locationOk, e := toolStock.LocationOk(ctx, t, locationCode)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if !locationOk {
+		e = fmt.Errorf("馆编码无效")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 锁定图书, 与借还互斥
+	var bookState string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j->>'state' from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, in.GetCode())).Scan(&bookState)
+	if e != nil && e != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if e == pgx.ErrNoRows || bookState != "正常" {
+		e = fmt.Errorf(`图书编码无效:%s`, in.GetCode())
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 不能重复预约
+	var count int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'username' = '%s' and j->>'code' = '%s' and j->>'state' in ('排队', '待取')`, toolSql.TableNameReservation, username, in.GetCode())).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if count > 0 {
+		e = fmt.Errorf(`已经预约此书:%s`, in.GetCode())
+		return nil, status.Errorf(codes.AlreadyExists, e.Error())
+	}
+
+	// 有可借库存时直接借阅
+	e = refreshHolds(ctx, t, in.GetCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	available, e := availableCount(ctx, t, in.GetCode(), locationCode)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if available > 0 {
+		e = fmt.Errorf(`该馆有可借库存, 请直接借阅:%s`, in.GetCode())
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 保存入库
+	info := borrow.ReserveInfo{
+		Id:           uuid.New().String(),
+		DateText:     time.Now().Format("2006-01-02T15:04:05"),
+		Username:     username,
+		Code:         in.GetCode(),
+		LocationCode: locationCode,
+		State:        "排队",
+	}
+	infoText, _ := toolApi.ProtoToJson(&info)
+	_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameReservation, infoText))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	info.QueuePosition, e = queuePosition(ctx, t, &info)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	return &info, nil
+}
+
+func (s *server) CancelReserve(ctx context.Context, in *borrow.CancelReserveRequest) (*borrow.ReserveInfo, error) {
+	// 基本检查
+	if in.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要预约id")
+	}
+
+	// 上下文中获取用户名和角色
+	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+	userRole := ctx.Value(toolApi.ContextKeyUserRole).(string)
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 查询预约
+	info, e := getReserveInfo(ctx, t, in.GetId())
+	if e == pgx.ErrNoRows {
+		e = fmt.Errorf("预约id无效")
+		return nil, status.Errorf(codes.NotFound, e.Error())
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if userRole == toolRole.Reader && info.GetUsername() != username {
+		e = fmt.Errorf("预约id无效")
+		return nil, status.Errorf(codes.NotFound, e.Error())
+	}
+	if tool.ArrayIndex(info.GetState(), []string{"排队", "待取"}) == -1 {
+		e = fmt.Errorf("预约已%s", info.GetState())
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 取消
+	info.State = "取消"
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "取消"}' where j->>'id' = '%s';`, toolSql.TableNameReservation, in.GetId()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 保留的库存给下一位
+	e = refreshHolds(ctx, t, info.GetCode())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return info, nil
+}
+
+func (s *server) SearchReserve(ctx context.Context, in *borrow.SearchReserveRequest) (*borrow.SearchReserveResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+
+	// 读者只能查询自己的预约
+	username := in.GetUsername()
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) == toolRole.Reader {
+		username = ctx.Value(toolApi.ContextKeyUserId).(string)
+	}
+
+	sqlWhere := `1 = 1`
+	if username != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'username' = '%s'`, sqlWhere, username)
+	}
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'code' = '%s'`, sqlWhere, in.GetCode())
+	}
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameReservation, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'date_text', j->>'id' offset %v limit %v`, toolSql.TableNameReservation, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*borrow.ReserveInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			rows.Close()
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info borrow.ReserveInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			rows.Close()
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	rows.Close()
+
+	// 计算排队位置, 超过保留期限的待取显示为过期
+	now := time.Now().Format("2006-01-02T15:04:05")
+	for _, info := range infoArray {
+		if info.GetState() == "待取" && info.GetPickupDeadline() < now {
+			info.State = "过期"
+		}
+		info.QueuePosition, e = queuePosition(ctx, sdb, info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	result := borrow.SearchReserveResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
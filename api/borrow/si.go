@@ -7,7 +7,12 @@ import (
 	"gs/proto/borrow"
 	"gs/tool"
 	toolApi "gs/tool/api"
+	toolIdempotency "gs/tool/idempotency"
+	toolOutbox "gs/tool/outbox"
+	toolRole "gs/tool/role"
 	toolSql "gs/tool/sql"
+	toolStock "gs/tool/stock"
+	toolTier "gs/tool/tier"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,6 +21,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // 实现服务
@@ -34,15 +40,51 @@ func Register(s grpc.ServiceRegistrar) {
 
 func (s *server) OutIn(ctx context.Context, in *borrow.OutInInfo) (*borrow.Empty, error) {
 	// 基本检查
-	if tool.ArrayIndex(in.GetType(), []string{"借出", "归还"}) == -1 {
+	if tool.ArrayIndex(in.GetType(), []string{"借出", "归还", "遗失", "损坏"}) == -1 {
 		return nil, status.Errorf(codes.InvalidArgument, "类型无效")
 	}
-	if len(in.GetBooks()) == 0 {
+	if in.GetType() == "遗失" || in.GetType() == "损坏" {
+		if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+			return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以登记遗失和损坏")
+		}
+		if in.GetReplacementAmount() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "赔偿金额不能小于0")
+		}
+	} else if in.GetReplacementAmount() != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "赔偿金额只能用于遗失和损坏")
+	}
+	if len(in.GetBooks()) == 0 && len(in.GetBarcodes()) == 0 {
 		return nil, status.Errorf(codes.InvalidArgument, "需要图书信息")
 	}
+	e := mergeRequestBooks(in)
+	if e != nil {
+		return nil, e
+	}
 
-	// 上下文中获取用户名
-	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+	// 序列化失败或死锁时重试, 每次使用请求的副本
+	var result *borrow.Empty
+	e = toolSql.Retry(ctx, func() error {
+		r, e := outIn(ctx, proto.Clone(in).(*borrow.OutInInfo))
+		result = r
+		return e
+	})
+	return result, e
+}
+
+// 借出归还事务
+func outIn(ctx context.Context, in *borrow.OutInInfo) (*borrow.Empty, error) {
+
+	locationCode := toolStock.LocationCode(in.GetLocationCode())
+	in.LocationCode = locationCode
+
+	// 上下文中获取用户名, 馆员可以代读者借还
+	operator := ctx.Value(toolApi.ContextKeyUserId).(string)
+	username := operator
+	if in.GetReaderUsername() != "" || in.GetReaderCardNumber() != "" {
+		if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+			return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以代读者借还")
+		}
+	}
 
 	// 准备事务
 	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
@@ -59,128 +101,254 @@ func (s *server) OutIn(ctx context.Context, in *borrow.OutInInfo) (*borrow.Empty
 		}
 	}()
 
-	// 检查用户名(演示时不作实现)
-
-	// 更新图书数量
-	sqlTemplate := `update %s set j = jsonb_set(j, '{borrow_count}', concat('', cast(j->>'borrow_count' as integer) + %d, '')::jsonb) where j->>'code' = '%s' and cast(j->>'borrow_count' as integer) + %d <= cast(j->>'total_count' as integer);`
-	if in.GetType() == "归还" {
-		sqlTemplate = `update %s set j = jsonb_set(j, '{borrow_count}', concat('', cast(j->>'borrow_count' as integer) - %d, '')::jsonb) where j->>'code' = '%s' and cast(j->>'borrow_count' as integer) - %d >= 0;`
+	// 幂等键: 保留期内重复请求返回原来的结果
+	idempotencyKey, error := toolIdempotency.GetKey(ctx)
+	if error != nil {
+		e = error
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
 	}
-	for _, bookInfo := range in.GetBooks() {
-		tag, error := t.Exec(ctx, fmt.Sprintf(sqlTemplate, toolSql.TableNameBook, bookInfo.GetCount(), bookInfo.GetCode(), bookInfo.GetCount()))
-		if error != nil {
+	if idempotencyKey != "" {
+		response, error := toolIdempotency.Check(ctx, t, idempotencyKey, operator, in)
+		if error == toolIdempotency.ErrMismatch {
+			e = error
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		} else if error != nil {
 			e = error
 			return nil, status.Errorf(codes.Internal, e.Error())
 		}
-		if tag.RowsAffected() == 0 {
-			if in.GetType() == "借出" {
-				e = fmt.Errorf(`图书编码无效或库存数量不足:%s`, bookInfo.GetCode())
-			} else {
-				e = fmt.Errorf(`图书编码无效或归还数量过多:%s`, bookInfo.GetCode())
+		if response != "" {
+			var result borrow.Empty
+			e = toolApi.JsonToProto(response, &result)
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
 			}
-			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+			return &result, nil
 		}
 	}
 
-	// 查询用户在借
-	bookMap := make(map[string]int32)
-	var userBorrow borrow.UserBorrow
-	var userBorrowJsonText string
-	e = t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'username' = '%s' FOR UPDATE;`, toolSql.TableNameUserBorrow, username)).Scan(&userBorrowJsonText)
-	if e == pgx.ErrNoRows {
-		e = nil
-		if in.GetType() == "借出" {
-			for _, bookInfo := range in.GetBooks() {
-				bookMap[bookInfo.GetCode()] = bookInfo.GetCount()
-			}
-		} else {
-			e = fmt.Errorf(`没有借出记录`)
-			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	// 按图书编码顺序锁定图书, 避免死锁
+	e = lockBooks(ctx, t, in)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 检查读者
+	if in.GetReaderUsername() != "" || in.GetReaderCardNumber() != "" {
+		username, e = getReader(ctx, t, in.GetReaderUsername(), in.GetReaderCardNumber())
+		if e != nil {
+			return nil, e
 		}
+	}
+
+	// 查询会员等级
+	tierInfo, e := toolTier.UserTier(ctx, t, username)
+	if e == pgx.ErrNoRows {
+		e = fmt.Errorf("用户名或会员等级无效")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
 	} else if e != nil {
 		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 检查馆
+	locationOk, e := toolStock.LocationOk(ctx, t, locationCode)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if !locationOk {
+		e = fmt.Errorf("馆编码无效")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 查询用户在借
+	userBorrow, e := getUserBorrow(ctx, t, username)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 计算借还图书
+	var books []*borrow.BookInfo
+	if in.GetType() == "借出" {
+		books, e = outBooks(ctx, t, in, locationCode)
 	} else {
-		e = toolApi.JsonToProto(userBorrowJsonText, &userBorrow)
+		books, e = inBooks(ctx, t, in, locationCode, userBorrow, closeCopyState(in.GetType()))
+	}
+	if e != nil {
+		return nil, e
+	}
+	in.Books = books
+	in.Barcodes = nil
+
+	// 借出时设置应还日期
+	if in.GetType() == "借出" {
+		dueDate := time.Now().AddDate(0, 0, int(tierInfo.GetLoanDays())).Format("2006-01-02")
+		for _, bookInfo := range books {
+			bookInfo.DueDate = dueDate
+		}
+	}
+
+	// 检查会员等级限制
+	if in.GetType() == "借出" {
+		e = checkTierLimit(tierInfo, append(append([]*borrow.BookInfo{}, userBorrow.GetBooks()...), books...))
+		if e != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+
+		// 未付罚款超过限额不能借出
+		unpaidAmount, error := unpaidFineAmount(ctx, t, username)
+		if error != nil {
+			e = error
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if unpaidAmount > tierInfo.GetFineBlockAmount() {
+			e = fmt.Errorf(`未付罚款%d分超过限额%d分, 不能借出`, unpaidAmount, tierInfo.GetFineBlockAmount())
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+	}
+
+	// 更新库存
+	for _, bookInfo := range in.GetBooks() {
+		copyOk, error := hasCopy(ctx, t, bookInfo.GetCode())
+		if error != nil {
+			e = error
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+
+		// 先刷新预约, 过期的待取保留给下一位读者, 借出时不能借走
+		e = refreshHolds(ctx, t, bookInfo.GetCode())
 		if e != nil {
 			return nil, status.Errorf(codes.Internal, e.Error())
 		}
 
 		if in.GetType() == "借出" {
-			for _, bookInfo := range userBorrow.GetBooks() {
-				bookMap[bookInfo.GetCode()] = bookInfo.GetCount()
+			// 删除的图书不能借出
+			var bookState string
+			e = t.QueryRow(ctx, fmt.Sprintf(`select j->>'state' from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameBook, bookInfo.GetCode())).Scan(&bookState)
+			if e != nil && e != pgx.ErrNoRows {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			if e == pgx.ErrNoRows || bookState != "正常" {
+				e = fmt.Errorf(`图书编码无效:%s`, bookInfo.GetCode())
+				return nil, status.Errorf(codes.InvalidArgument, e.Error())
 			}
 
-			for _, bookInfo := range in.GetBooks() {
-				count, exists := bookMap[bookInfo.GetCode()]
-				if exists {
-					bookMap[bookInfo.GetCode()] = count + bookInfo.GetCount()
-				} else {
-					bookMap[bookInfo.GetCode()] = bookInfo.GetCount()
-				}
+			if copyOk {
+				e = toolStock.SyncCopy(ctx, t, bookInfo.GetCode())
+			} else {
+				e = toolStock.Change(ctx, t, bookInfo.GetCode(), locationCode, 0, bookInfo.GetCount())
 			}
-		} else {
-			for _, bookInfo := range userBorrow.GetBooks() {
-				bookMap[bookInfo.GetCode()] = bookInfo.GetCount()
+		} else if in.GetType() != "归还" {
+			// 遗失和损坏的图书不再流通, 从借出馆的库存中扣除
+			if copyOk {
+				e = toolStock.SyncCopy(ctx, t, bookInfo.GetCode())
+			} else {
+				e = toolStock.Change(ctx, t, bookInfo.GetCode(), bookInfo.GetLocationCode(), -bookInfo.GetCount(), -bookInfo.GetCount())
 			}
-
-			for _, bookInfo := range in.GetBooks() {
-				count, exists := bookMap[bookInfo.GetCode()]
-				if exists {
-					diffCount := count - bookInfo.GetCount()
-
-					if diffCount < 0 {
-						e = fmt.Errorf(`归还数量超过借阅:%s`, bookInfo.GetCode())
-						return nil, status.Errorf(codes.InvalidArgument, e.Error())
-					} else if diffCount == 0 {
-						delete(bookMap, bookInfo.GetCode())
-					} else {
-						bookMap[bookInfo.GetCode()] = diffCount
+		} else {
+			if copyOk {
+				e = toolStock.SyncCopy(ctx, t, bookInfo.GetCode())
+			} else {
+				// 归还到其它馆时, 库存调入该馆
+				e = toolStock.Change(ctx, t, bookInfo.GetCode(), bookInfo.GetLocationCode(), 0, -bookInfo.GetCount())
+				if e == nil && bookInfo.GetLocationCode() != locationCode {
+					e = toolStock.Change(ctx, t, bookInfo.GetCode(), bookInfo.GetLocationCode(), -bookInfo.GetCount(), 0)
+					if e == nil {
+						e = toolStock.Change(ctx, t, bookInfo.GetCode(), locationCode, bookInfo.GetCount(), 0)
 					}
-				} else {
-					e = fmt.Errorf(`没有借阅此书:%s`, bookInfo.GetCode())
-					return nil, status.Errorf(codes.InvalidArgument, e.Error())
 				}
 			}
 		}
-	}
-	// 更新用户在借
-	var books []*borrow.BookInfo
-	for code, count := range bookMap {
-		books = append(books, &borrow.BookInfo{Code: code, Count: count})
-	}
-	if len(books) > 0 {
-		userBorrow = borrow.UserBorrow{Username: username, Books: books}
-		userBorrowJsonText, _ = toolApi.ProtoToJson(&userBorrow)
-		tag, error := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s') ON CONFLICT ((j->'username')) DO UPDATE SET j = EXCLUDED.j;`, toolSql.TableNameUserBorrow, userBorrowJsonText))
-		if error != nil {
-			e = error
+		if e == toolStock.ErrCount {
+			if in.GetType() == "借出" {
+				e = fmt.Errorf(`图书编码无效或库存数量不足:%s`, bookInfo.GetCode())
+			} else {
+				e = fmt.Errorf(`图书编码无效或归还数量过多:%s`, bookInfo.GetCode())
+			}
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		} else if e != nil {
 			return nil, status.Errorf(codes.Internal, e.Error())
 		}
-		if tag.RowsAffected() == 0 {
-			e = fmt.Errorf(`用户在借没有保存`)
-			return nil, status.Errorf(codes.InvalidArgument, "用户在借没有保存")
+
+		if in.GetType() == "归还" {
+			// 归还的库存保留给排队的读者
+			e = refreshHolds(ctx, t, bookInfo.GetCode())
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+		} else if in.GetType() == "借出" {
+			// 完成自己的预约, 不能借出保留给其他读者的库存
+			e = fulfillHolds(ctx, t, username, bookInfo.GetCode(), locationCode, bookInfo.GetCount())
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			available, error := availableCount(ctx, t, bookInfo.GetCode(), locationCode)
+			if error != nil {
+				e = error
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			if available < 0 {
+				e = fmt.Errorf(`库存已保留给预约的读者:%s`, bookInfo.GetCode())
+				return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+			}
 		}
-	} else {
-		_, error := t.Exec(ctx, fmt.Sprintf(`delete from %s where j->>'username' = '%s';`, toolSql.TableNameUserBorrow, username))
-		if error != nil {
-			e = error
-			return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 计算用户在借
+	if in.GetType() == "借出" {
+		for _, bookInfo := range in.GetBooks() {
+			mergeLot(userBorrow, bookInfo)
 		}
+
+	}
+
+	// 更新用户在借
+	e = saveUserBorrow(ctx, t, userBorrow)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
 	}
 
 	// 保存入库
 	in.Id = uuid.New().String()
 	in.DateText = time.Now().Format("2006-01-02T15:04:05")
 	in.Username = username
-	inText, _ := toolApi.ProtoToJson(in)
-	tag, error := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameBorrowOutIn, inText))
-	if error != nil {
-		e = error
+	in.Operator = operator
+
+	// 逾期归还(含遗失和损坏)记录罚款
+	if in.GetType() != "借出" {
+		e = addFines(ctx, t, in, tierInfo)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 遗失和损坏记录库存调整和赔偿
+	if in.GetType() == "遗失" || in.GetType() == "损坏" {
+		e = addLossAdjusts(ctx, t, in)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		e = addReplacementFines(ctx, t, in)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	e = addOutIn(ctx, t, in)
+	if e != nil {
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
-	if tag.RowsAffected() == 0 {
-		e = fmt.Errorf(`借还记录没有保存`)
-		return nil, status.Errorf(codes.InvalidArgument, "借还记录没有保存")
+
+	// 记录事件
+	e = toolOutbox.Add(ctx, t, in.GetType(), in)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 保存幂等键结果
+	if idempotencyKey != "" {
+		e = toolIdempotency.Save(ctx, t, idempotencyKey, operator, &borrow.Empty{})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
 	}
 
 	return &borrow.Empty{}, nil
@@ -2,15 +2,27 @@ package borrow
 
 import (
 	"context"
+	"fmt"
+	"gs/proto/book"
 	"gs/proto/borrow"
+	"gs/proto/user"
 	toolApi "gs/tool/api"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 var mc context.Context
 var gc borrow.BorrowClient
+var bc book.BookClient
+var uc user.UserClient
 
 func TestMain(m *testing.M) {
 	// 创建连接
@@ -27,6 +39,8 @@ func TestMain(m *testing.M) {
 
 	// 创建客户端
 	gc = borrow.NewBorrowClient(conn)
+	bc = book.NewBookClient(conn)
+	uc = user.NewUserClient(conn)
 
 	m.Run()
 }
@@ -57,6 +71,23 @@ func TestOut2(t *testing.T) {
 	t.Log(result)
 }
 
+func TestOutTierLimit(t *testing.T) {
+	// 默认等级每种图书最多在借5本
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 6})
+	_, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "借出",
+		Books: books,
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("会员等级限制", gs.Code(), gs.Message())
+	}
+}
+
 func TestIn1(t *testing.T) {
 	var books []*borrow.BookInfo
 	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
@@ -83,6 +114,55 @@ func TestIn2(t *testing.T) {
 	t.Log(result)
 }
 
+func TestOutLocation(t *testing.T) {
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN2", Count: 1})
+	result, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:         "借出",
+		Books:        books,
+		LocationCode: "东区分馆",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestInLocation(t *testing.T) {
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN2", Count: 1})
+	result, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestOutCopy(t *testing.T) {
+	result, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:     "借出",
+		Barcodes: []string{"SN3-001"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestInCopy(t *testing.T) {
+	result, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:     "归还",
+		Barcodes: []string{"SN3-001"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
 func TestQueryUserBorrow(t *testing.T) {
 	result, e := gc.QueryUserBorrow(mc, &borrow.Empty{})
 
@@ -91,3 +171,538 @@ func TestQueryUserBorrow(t *testing.T) {
 	}
 	t.Log(result)
 }
+
+func TestHolders(t *testing.T) {
+	// 在借用户与用户在借一致
+	userBorrow, e := gc.QueryUserBorrow(mc, &borrow.Empty{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var count int32
+	for _, bookInfo := range userBorrow.GetBooks() {
+		if bookInfo.GetCode() == "SN2" {
+			count += bookInfo.GetCount()
+		}
+	}
+
+	result, e := gc.Holders(mc, &borrow.HoldersRequest{Code: "SN2"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, info := range result.GetInfoArray() {
+		if info.GetUsername() == userBorrow.GetUsername() && info.GetCount() != count {
+			t.Fatal("在借数量", info.GetCount(), count)
+		}
+	}
+	t.Log(result)
+}
+
+func TestDueDate(t *testing.T) {
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
+	_, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "借出",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 借出的图书有应还日期
+	result, e := gc.QueryUserBorrow(mc, &borrow.Empty{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	today := time.Now().Format("2006-01-02")
+	found := false
+	for _, bookInfo := range result.GetBooks() {
+		if bookInfo.GetCode() == "SN1" && bookInfo.GetDueDate() > today {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("应还日期", result)
+	}
+
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	// 没有借阅此书
+	_, e := gc.Renew(mc, &borrow.RenewRequest{
+		Codes: []string{"没有借阅"},
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("没有借阅此书", gs.Code(), gs.Message())
+	}
+
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "借出",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 续借
+	result, e := gc.Renew(mc, &borrow.RenewRequest{
+		Codes: []string{"SN1"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, bookInfo := range result.GetBooks() {
+		if bookInfo.GetCode() == "SN1" && bookInfo.GetRenewCount() < 1 {
+			t.Fatal("续借次数", bookInfo)
+		}
+	}
+	t.Log(result)
+
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestRenewReserved(t *testing.T) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer ctxCancel()
+	// 馆员和读者分别使用自己的凭证
+	lc := toolApi.GetGrpcMetadata(ctx)
+
+	// 添加只有1本的图书并借出
+	code := fmt.Sprint("测试续借预约-", uuid.New().String())
+	_, e := bc.Add(lc, &book.Info{
+		Code:       code,
+		Name:       "测试续借预约",
+		TotalCount: 1,
+		State:      "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	books := []*borrow.BookInfo{{Code: code, Count: 1}}
+	_, e = gc.OutIn(lc, &borrow.OutInInfo{
+		Type:  "借出",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 其他读者预约
+	username := fmt.Sprint("测试续借预约-", uuid.New().String())
+	_, e = uc.Add(lc, &user.Info{
+		Username: username,
+		State:    "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer uc.Change(lc, &user.ChangeRequest{Info: &user.Info{Username: username, State: "删除"}})
+	authResult, e := uc.Auth(ctx, &user.AuthRequest{Username: username})
+	if e != nil {
+		t.Fatal(e)
+	}
+	readerCtx := metadata.AppendToOutgoingContext(ctx, "x-token", authResult.GetToken())
+	reserveInfo, e := gc.Reserve(readerCtx, &borrow.ReserveRequest{Code: code})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 有其他读者预约时不能续借
+	_, e = gc.Renew(lc, &borrow.RenewRequest{
+		Codes: []string{code},
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("其他读者已预约", gs.Code(), gs.Message())
+	}
+
+	// 取消预约后归还
+	_, e = gc.CancelReserve(readerCtx, &borrow.CancelReserveRequest{Id: reserveInfo.GetId()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = gc.OutIn(lc, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	// 图书编码无效
+	_, e := gc.Reserve(mc, &borrow.ReserveRequest{
+		Code: "没有此书",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("图书编码无效", gs.Code(), gs.Message())
+	}
+
+	// 预约id无效
+	_, e = gc.CancelReserve(mc, &borrow.CancelReserveRequest{
+		Id: "无效",
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("预约id无效", gs.Code(), gs.Message())
+	}
+}
+
+func TestSearchReserve(t *testing.T) {
+	result, e := gc.SearchReserve(mc, &borrow.SearchReserveRequest{
+		PageStart: 1,
+		PageCount: 10,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestHistory(t *testing.T) {
+	// 类型无效
+	_, e := gc.History(mc, &borrow.HistoryRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Type:      "无效",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("类型无效", gs.Code(), gs.Message())
+	}
+
+	today := time.Now().Format("2006-01-02")
+	result, e := gc.History(mc, &borrow.HistoryRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Code:      "SN1",
+		Type:      "借出",
+		DateStart: today,
+		DateEnd:   today,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, info := range result.GetInfoArray() {
+		if info.GetType() != "借出" || info.GetDateText() < today {
+			t.Fatal("过滤条件", info)
+		}
+	}
+	t.Log(result)
+}
+
+func TestOutInForReader(t *testing.T) {
+	// 读者无效
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
+	_, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:           "借出",
+		Books:          books,
+		ReaderUsername: "没有此读者",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("读者无效", gs.Code(), gs.Message())
+	}
+
+	// 馆员代自己借还, 记录操作用户
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:           "借出",
+		Books:          books,
+		ReaderUsername: "测试",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:           "归还",
+		Books:          books,
+		ReaderUsername: "测试",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	result, e := gc.History(mc, &borrow.HistoryRequest{
+		PageStart: 1,
+		PageCount: 1,
+		Username:  "测试",
+		Operator:  "测试",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestLost(t *testing.T) {
+	// 赔偿金额只能用于遗失和损坏
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
+	_, e := gc.OutIn(mc, &borrow.OutInInfo{
+		Type:              "归还",
+		Books:             books,
+		ReplacementAmount: 2000,
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("赔偿金额", gs.Code(), gs.Message())
+	}
+
+	// 遗失后库存数量减少, 借出数量不变
+	before, e := bc.Get(mc, &book.GetRequest{Code: "SN1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "借出",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:              "遗失",
+		Books:             books,
+		ReplacementAmount: 2000,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	after, e := bc.Get(mc, &book.GetRequest{Code: "SN1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if after.GetTotalCount() != before.GetTotalCount()-1 || after.GetBorrowCount() != before.GetBorrowCount() {
+		t.Fatal("遗失库存", before, after)
+	}
+
+	result, e := gc.History(mc, &borrow.HistoryRequest{
+		PageStart: 1,
+		PageCount: 1,
+		Username:  "测试",
+		Type:      "遗失",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetCount() < 1 {
+		t.Fatal("遗失记录", result)
+	}
+	t.Log(result)
+}
+
+func TestOutIdempotency(t *testing.T) {
+	// 在借数量
+	borrowCount := func() int32 {
+		var count int32
+		result, e := gc.QueryUserBorrow(mc, &borrow.Empty{})
+		if e != nil {
+			return 0
+		}
+		for _, bookInfo := range result.GetBooks() {
+			if bookInfo.GetCode() == "SN1" {
+				count += bookInfo.GetCount()
+			}
+		}
+		return count
+	}
+	oldCount := borrowCount()
+
+	// 同一幂等键重复借出只借出一次
+	ctx := metadata.AppendToOutgoingContext(mc, "x-idempotency-key", uuid.New().String())
+	var books []*borrow.BookInfo
+	books = append(books, &borrow.BookInfo{Code: "SN1", Count: 1})
+	for i := 0; i < 2; i++ {
+		_, e := gc.OutIn(ctx, &borrow.OutInInfo{
+			Type:  "借出",
+			Books: books,
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if borrowCount() != oldCount+1 {
+		t.Fatal("重复借出", oldCount, borrowCount())
+	}
+
+	// 同一幂等键不能用于不同的请求
+	_, e := gc.OutIn(ctx, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("幂等键用于不同的请求", gs.Code(), gs.Message())
+	}
+
+	_, e = gc.OutIn(mc, &borrow.OutInInfo{
+		Type:  "归还",
+		Books: books,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestOutInConcurrent(t *testing.T) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer ctxCancel()
+	ctx = toolApi.GetGrpcMetadata(ctx)
+
+	// 添加图书, 库存足够全部读者同时借阅
+	const userCount = 4
+	const totalCount = 2 * userCount
+	var codeArray []string
+	for i := 0; i < 2; i++ {
+		code := fmt.Sprint("测试并发-", uuid.New().String())
+		_, e := bc.Add(ctx, &book.Info{
+			Code:       code,
+			Name:       "测试并发",
+			TotalCount: totalCount,
+			State:      "正常",
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer bc.Change(ctx, &book.Info{Code: code, Name: "测试并发", TotalCount: totalCount, State: "删除"})
+		codeArray = append(codeArray, code)
+	}
+
+	// 添加读者
+	var usernameArray []string
+	for i := 0; i < userCount; i++ {
+		username := fmt.Sprint("测试并发-", uuid.New().String())
+		_, e := uc.Add(ctx, &user.Info{
+			Username: username,
+			State:    "正常",
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer uc.Change(ctx, &user.ChangeRequest{Info: &user.Info{Username: username, State: "删除"}})
+		usernameArray = append(usernameArray, username)
+	}
+
+	// 并发借还, 一半按[A,B], 一半按[B,A]
+	var wg sync.WaitGroup
+	var successCount atomic.Int32
+	errorChan := make(chan error, len(usernameArray))
+	for i, username := range usernameArray {
+		order := codeArray
+		if i%2 == 1 {
+			order = []string{codeArray[1], codeArray[0]}
+		}
+		wg.Add(1)
+		go func(username string, order []string) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				books := []*borrow.BookInfo{{Code: order[0], Count: 1}, {Code: order[1], Count: 1}, {Code: order[0], Count: 1}}
+				_, e := gc.OutIn(ctx, &borrow.OutInInfo{
+					Type:           "借出",
+					Books:          books,
+					ReaderUsername: username,
+				})
+				if e != nil {
+					errorChan <- e
+					return
+				}
+				successCount.Add(1)
+
+				_, e = gc.OutIn(ctx, &borrow.OutInInfo{
+					Type:           "归还",
+					Books:          books,
+					ReaderUsername: username,
+				})
+				if e != nil {
+					errorChan <- e
+					return
+				}
+			}
+		}(username, order)
+	}
+	wg.Wait()
+	close(errorChan)
+	for e := range errorChan {
+		t.Fatal("并发借还", e)
+	}
+	if successCount.Load() == 0 {
+		t.Fatal("没有成功的借出")
+	}
+
+	// 借还后数量不变
+	after, e := bc.BatchGet(ctx, &book.BatchGetRequest{Codes: codeArray})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, info := range after.GetInfoArray() {
+		if info.GetTotalCount() != totalCount || info.GetBorrowCount() != 0 {
+			t.Fatal("数量不一致", info)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	// 只对账不修复
+	result, e := gc.Reconcile(mc, &borrow.ReconcileRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetRepaired() {
+		t.Fatal("只对账", result)
+	}
+
+	// 修复后再对账没有不一致
+	_, e = gc.Reconcile(mc, &borrow.ReconcileRequest{Repair: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	result, e = gc.Reconcile(mc, &borrow.ReconcileRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.GetInfoArray()) > 0 {
+		t.Fatal("修复后不一致", result.GetInfoArray())
+	}
+	t.Log(result)
+}
@@ -0,0 +1,319 @@
+package category
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/category"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	category.UnimplementedCategoryServer
+}
+
+var sdb *pgxpool.Pool
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	category.RegisterCategoryServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+// 查询分类路径
+//
+// 分类编码为空时返回根路径 /
+func getPath(ctx context.Context, t pgx.Tx, code string) (string, error) {
+	if code == "" {
+		return "/", nil
+	}
+
+	var path string
+	e := t.QueryRow(ctx, fmt.Sprintf(`select j->>'path' from %s where j->>'code' = '%s' FOR UPDATE;`, toolSql.TableNameCategory, code)).Scan(&path)
+	if e == pgx.ErrNoRows {
+		return "", status.Errorf(codes.InvalidArgument, "分类编码无效:%s", code)
+	} else if e != nil {
+		return "", status.Errorf(codes.Internal, e.Error())
+	}
+	return path, nil
+}
+
+func (s *server) Add(ctx context.Context, in *category.Info) (*category.Empty, error) {
+	// 基本校验
+	if in.GetCode() == "" || strings.Contains(in.GetCode(), "/") {
+		return nil, status.Errorf(codes.InvalidArgument, "分类编码无效")
+	}
+	if in.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要名称")
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 计算路径
+	parentPath, e := getPath(ctx, t, in.GetParentCode())
+	if e != nil {
+		return nil, e
+	}
+	in.Path = fmt.Sprint(parentPath, in.GetCode(), "/")
+
+	// 保存入库
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameCategory, inText))
+	if e != nil {
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, status.Errorf(codes.InvalidArgument, "分类编码重复")
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		e = fmt.Errorf("保存失败")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	return &category.Empty{}, nil
+}
+
+func (s *server) Rename(ctx context.Context, in *category.Info) (*category.Empty, error) {
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要分类编码")
+	}
+	if in.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要名称")
+	}
+
+	// 保存入库
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`update %s set j = jsonb_set(j, '{name}', to_jsonb('%s'::text)) where j->>'code' = '%s';`, toolSql.TableNameCategory, in.GetName(), in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "分类编码无效")
+	}
+
+	return &category.Empty{}, nil
+}
+
+func (s *server) Move(ctx context.Context, in *category.MoveRequest) (*category.Empty, error) {
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要分类编码")
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 查询路径
+	oldPath, e := getPath(ctx, t, in.GetCode())
+	if e != nil {
+		return nil, e
+	}
+	parentPath, e := getPath(ctx, t, in.GetParentCode())
+	if e != nil {
+		return nil, e
+	}
+	if strings.HasPrefix(parentPath, oldPath) {
+		e = fmt.Errorf("不能移动到自身或下级分类")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+	newPath := fmt.Sprint(parentPath, in.GetCode(), "/")
+
+	// 更新上级分类
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = jsonb_set(j, '{parent_code}', to_jsonb('%s'::text)) where j->>'code' = '%s';`, toolSql.TableNameCategory, in.GetParentCode(), in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 更新该分类及下级分类的路径
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = jsonb_set(j, '{path}', to_jsonb(concat('%s', substr(j->>'path', %d)))) where j->>'path' like '%s%%';`, toolSql.TableNameCategory, newPath, len([]rune(oldPath))+1, oldPath))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &category.Empty{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, in *category.DeleteRequest) (*category.Empty, error) {
+	if in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要分类编码")
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 检查下级分类
+	path, e := getPath(ctx, t, in.GetCode())
+	if e != nil {
+		return nil, e
+	}
+	var count int
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'path' like '%s_%%'`, toolSql.TableNameCategory, path)).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if count > 0 {
+		e = fmt.Errorf("有下级分类, 不能删除")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 检查图书
+	e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->'category_codes' ? '%s'`, toolSql.TableNameBook, in.GetCode())).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if count > 0 {
+		e = fmt.Errorf("有图书, 不能删除")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 删除
+	_, e = t.Exec(ctx, fmt.Sprintf(`delete from %s where j->>'code' = '%s';`, toolSql.TableNameCategory, in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &category.Empty{}, nil
+}
+
+func (s *server) Search(ctx context.Context, in *category.SearchRequest) (*category.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetKeyword() != "" {
+		sqlWhere = fmt.Sprintf(`%s and concat(j->>'code', j->>'name') like '%s'`,
+			sqlWhere,
+			fmt.Sprint(`%`, in.GetKeyword(), `%`),
+		)
+	}
+	if in.GetPath() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'path' like '%s%%'`, sqlWhere, in.GetPath())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameCategory, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'path' offset %v limit %v`, toolSql.TableNameCategory, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*category.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info category.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := category.SearchResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
+
+func (s *server) Assign(ctx context.Context, in *category.AssignRequest) (*category.Empty, error) {
+	if in.GetBookCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要图书编码")
+	}
+
+	// 整理标签: 去除空白和重复
+	tagArray := []string{}
+	tagMap := make(map[string]bool)
+	for _, tag := range in.GetTags() {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !tagMap[tag] {
+			tagMap[tag] = true
+			tagArray = append(tagArray, tag)
+		}
+	}
+
+	// 检查分类
+	categoryCodeArray := []string{}
+	categoryCodeMap := make(map[string]bool)
+	for _, code := range in.GetCategoryCodes() {
+		if categoryCodeMap[code] {
+			continue
+		}
+		var count int
+		e := sdb.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s'`, toolSql.TableNameCategory, code)).Scan(&count)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if count == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "分类编码无效:%s", code)
+		}
+		categoryCodeMap[code] = true
+		categoryCodeArray = append(categoryCodeArray, code)
+	}
+
+	// 保存入库
+	categoryCodesText, _ := json.Marshal(categoryCodeArray)
+	tagsText, _ := json.Marshal(tagArray)
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('category_codes', '%s'::jsonb, 'tags', '%s'::jsonb) where j->>'code' = '%s';`, toolSql.TableNameBook, categoryCodesText, tagsText, in.GetBookCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "图书编码无效")
+	}
+
+	return &category.Empty{}, nil
+}
@@ -0,0 +1,140 @@
+package category
+
+import (
+	"context"
+	"gs/proto/category"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc category.CategoryClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = category.NewCategoryClient(conn)
+
+	m.Run()
+}
+
+func TestAdd1(t *testing.T) {
+	result, e := gc.Add(mc, &category.Info{
+		Code: "T",
+		Name: "工业技术",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestAdd2(t *testing.T) {
+	result, e := gc.Add(mc, &category.Info{
+		Code:       "TP",
+		Name:       "自动化技术、计算机技术",
+		ParentCode: "T",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestAdd3(t *testing.T) {
+	result, e := gc.Add(mc, &category.Info{
+		Code: "TP3",
+		Name: "计算技术、计算机技术",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestMove(t *testing.T) {
+	// 不能移动到下级分类
+	_, e := gc.Move(mc, &category.MoveRequest{
+		Code:       "T",
+		ParentCode: "TP",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("不能移动到下级分类", gs.Code(), gs.Message())
+	}
+
+	// 正常移动
+	_, e = gc.Move(mc, &category.MoveRequest{
+		Code:       "TP3",
+		ParentCode: "TP",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestRename(t *testing.T) {
+	result, e := gc.Rename(mc, &category.Info{
+		Code: "TP3",
+		Name: "计算技术",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestAssign(t *testing.T) {
+	result, e := gc.Assign(mc, &category.AssignRequest{
+		BookCode:      "SN1",
+		CategoryCodes: []string{"TP3"},
+		Tags:          []string{"架构", "入门"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestDelete(t *testing.T) {
+	// 有下级分类
+	_, e := gc.Delete(mc, &category.DeleteRequest{Code: "TP"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("有下级分类", gs.Code(), gs.Message())
+	}
+}
+
+func TestSearch(t *testing.T) {
+	result, e := gc.Search(mc, &category.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Path:      "/T/",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
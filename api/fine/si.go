@@ -0,0 +1,200 @@
+package fine
+
+import (
+	"context"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/fine"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	fine.UnimplementedFineServer
+}
+
+var sdb *pgxpool.Pool
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	fine.RegisterFineServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+func (s *server) Search(ctx context.Context, in *fine.SearchRequest) (*fine.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	if in.GetState() != "" && tool.ArrayIndex(in.GetState(), []string{"未付", "已付", "减免"}) == -1 {
+		return nil, status.Errorf(codes.InvalidArgument, "状态无效")
+	}
+
+	// 读者只能查询自己的罚款
+	username := in.GetUsername()
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) == toolRole.Reader {
+		username = ctx.Value(toolApi.ContextKeyUserId).(string)
+	}
+
+	sqlWhere := `1 = 1`
+	if username != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'username' = '%s'`, sqlWhere, username)
+	}
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*), coalesce(sum(cast(j->>'amount' as integer) - cast(j->>'paid_amount' as integer)) filter (where j->>'state' = '未付'), 0) from %s where %s`, toolSql.TableNameFine, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'date_text' desc offset %v limit %v`, toolSql.TableNameFine, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count, unpaidAmount int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count, &unpaidAmount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var infoArray []*fine.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info fine.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := fine.SearchResponse{Count: count, InfoArray: infoArray, UnpaidAmount: unpaidAmount}
+	return &result, nil
+}
+
+// 修改未付罚款
+//
+// 在事务中锁定罚款, 调用 change 修改后保存
+func changeFine(ctx context.Context, id string, change func(info *fine.Info) error) (*fine.Info, error) {
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定罚款
+	var jsonText string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'id' = '%s' FOR UPDATE;`, toolSql.TableNameFine, id)).Scan(&jsonText)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.NotFound, "罚款id无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var info fine.Info
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if info.GetState() != "未付" {
+		e = fmt.Errorf("罚款已%s", info.GetState())
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 修改
+	e = change(&info)
+	if e != nil {
+		return nil, e
+	}
+
+	// 保存入库
+	infoText, _ := toolApi.ProtoToJson(&info)
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = '%s' where j->>'id' = '%s';`, toolSql.TableNameFine, infoText, id))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &info, nil
+}
+
+func (s *server) Pay(ctx context.Context, in *fine.PayRequest) (*fine.Info, error) {
+	// 基本校验
+	if in.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要罚款id")
+	}
+	if in.GetAmount() < 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "支付金额必须大于0")
+	}
+	// 支付由馆员收款后登记, 读者不能自行登记
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+		return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以登记支付")
+	}
+	operator := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	return changeFine(ctx, in.GetId(), func(info *fine.Info) error {
+		if in.GetAmount() > info.GetAmount()-info.GetPaidAmount() {
+			return status.Errorf(codes.InvalidArgument, "支付金额超过未付金额:%d", info.GetAmount()-info.GetPaidAmount())
+		}
+
+		info.PaidAmount += in.GetAmount()
+		if info.GetPaidAmount() == info.GetAmount() {
+			info.State = "已付"
+		}
+		info.PaymentArray = append(info.PaymentArray, &fine.PaymentInfo{
+			DateText: time.Now().Format("2006-01-02T15:04:05"),
+			Type:     "支付",
+			Amount:   in.GetAmount(),
+			Operator: operator,
+		})
+		return nil
+	})
+}
+
+func (s *server) Waive(ctx context.Context, in *fine.WaiveRequest) (*fine.Info, error) {
+	// 基本校验
+	if in.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要罚款id")
+	}
+	if in.GetReason() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要原因")
+	}
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+		return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以减免罚款")
+	}
+	operator := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	return changeFine(ctx, in.GetId(), func(info *fine.Info) error {
+		info.State = "减免"
+		info.PaymentArray = append(info.PaymentArray, &fine.PaymentInfo{
+			DateText: time.Now().Format("2006-01-02T15:04:05"),
+			Type:     "减免",
+			Amount:   info.GetAmount() - info.GetPaidAmount(),
+			Operator: operator,
+			Reason:   in.GetReason(),
+		})
+		return nil
+	})
+}
@@ -0,0 +1,88 @@
+package fine
+
+import (
+	"context"
+	"gs/proto/fine"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc fine.FineClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = fine.NewFineClient(conn)
+
+	m.Run()
+}
+
+func TestSearch(t *testing.T) {
+	result, e := gc.Search(mc, &fine.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+		State:     "未付",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestPay(t *testing.T) {
+	// 支付金额
+	_, e := gc.Pay(mc, &fine.PayRequest{
+		Id: "无效",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("支付金额", gs.Code(), gs.Message())
+	}
+
+	// 罚款id无效
+	_, e = gc.Pay(mc, &fine.PayRequest{
+		Id:     "无效",
+		Amount: 1,
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("罚款id无效", gs.Code(), gs.Message())
+	}
+}
+
+func TestWaive(t *testing.T) {
+	// 需要原因
+	_, e := gc.Waive(mc, &fine.WaiveRequest{
+		Id: "无效",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("需要原因", gs.Code(), gs.Message())
+	}
+}
@@ -5,7 +5,14 @@ import (
 	"fmt"
 	"gs/api/book"
 	"gs/api/borrow"
+	"gs/api/category"
+	"gs/api/fine"
+	"gs/api/location"
+	"gs/api/overdue"
+	"gs/api/report"
+	"gs/api/tier"
 	"gs/api/user"
+	"gs/api/webhook"
 	"gs/filelog"
 	"net"
 	"os"
@@ -14,6 +21,7 @@ import (
 	toolApi "gs/tool/api"
 	toolCache "gs/tool/cache"
 	"gs/tool/env"
+	toolRole "gs/tool/role"
 	toolSql "gs/tool/sql"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -36,11 +44,15 @@ type metadataInfo struct {
 var (
 	// 公开方法(无需登录)
 	publicMethodMap = map[string]int{
-		"/user.User/Auth": 1, // 用户:授权
+		"/user.User/Auth":             1, // 用户:授权
+		"/user.User/Register":         1, // 用户:注册
+		"/user.User/VerifyEmail":      1, // 用户:验证电子邮箱
+		"/user.User/ResendVerifyCode": 1, // 用户:重发验证码
 	}
 	// 保护方法(需要登录)
 	protectMethodMap = map[string]int{
 		"/user.User/Exit": 1, // 用户:退出
+		"/user.User/Me":   1, // 用户:当前用户
 	}
 )
 
@@ -90,36 +102,38 @@ func getMetadataInfo(ctx context.Context) (*metadataInfo, error) {
 	return &mi, nil
 }
 
-// 检查权限
-func checkPermission(mi *metadataInfo, fullMethod string) (string, error) {
+// 检查权限, 返回用户id和角色
+func checkPermission(mi *metadataInfo, fullMethod string) (string, string, error) {
 	// 公开接口
 	_, isPublic := publicMethodMap[fullMethod]
 	if isPublic {
 		filelog.Debug("公开接口", fullMethod)
-		return "", nil
+		return "", "", nil
 	}
 
 	// 使用凭证
 	userId := toolCache.GetTokenUser(mi.Token)
 	if userId == "" {
-		return "", fmt.Errorf("凭证无效")
+		return "", "", fmt.Errorf("凭证无效")
 	}
 
+	// 登录时记录的角色
+	userRole := toolRole.Name(toolCache.GetTokenRole(mi.Token))
+
 	// 保护接口
 	_, isProtect := protectMethodMap[fullMethod]
 	if isProtect {
 		filelog.Debug("保护接口", fullMethod)
-		return userId, nil
+		return userId, userRole, nil
 	}
 
-	// TODO 权限接口
-	hasApi := true
-	if hasApi {
+	// 权限接口
+	if toolRole.Allowed(userRole, fullMethod) {
 		filelog.Debug("权限接口", fullMethod)
-		return userId, nil
+		return userId, userRole, nil
 	}
 
-	return "", fmt.Errorf("没有权限")
+	return "", "", fmt.Errorf("没有权限")
 }
 
 // 单式拦截器
@@ -135,7 +149,7 @@ func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServ
 	}
 
 	// 检查权限
-	userId, e := checkPermission(mi, info.FullMethod)
+	userId, userRole, e := checkPermission(mi, info.FullMethod)
 	if e != nil {
 		filelog.Warn("调用单式接口失败", "接口", info.FullMethod, "请求", requestJsonText, "没有权限", e.Error())
 		return nil, status.Errorf(codes.PermissionDenied, e.Error())
@@ -145,6 +159,7 @@ func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServ
 	ctx = context.WithValue(ctx, toolApi.ContextKeyClientIp, mi.Ip)
 	ctx = context.WithValue(ctx, toolApi.ContextKeyUserToken, mi.Token)
 	ctx = context.WithValue(ctx, toolApi.ContextKeyUserId, userId)
+	ctx = context.WithValue(ctx, toolApi.ContextKeyUserRole, userRole)
 
 	// 处理
 	resp, e := handler(ctx, req)
@@ -159,12 +174,47 @@ func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServ
 	return resp, e
 }
 
+// 流式上下文, 用于传递上下文数据
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
 // 流式拦截器
 // 注意:流式拦截器无法在拦截器中获取请求或返回内容!
 func streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	filelog.Info("调用流式接口开始", "接口", info.FullMethod, "暂时不能使用流式接口!")
+	ctx := ss.Context()
+
+	// 获取元数据
+	mi, e := getMetadataInfo(ctx)
+	if e != nil {
+		filelog.Warn("调用流式接口失败", "接口", info.FullMethod, "获取元数据失败", e.Error())
+		return status.Errorf(codes.Aborted, e.Error())
+	}
+
+	// 检查权限
+	userId, userRole, e := checkPermission(mi, info.FullMethod)
+	if e != nil {
+		filelog.Warn("调用流式接口失败", "接口", info.FullMethod, "没有权限", e.Error())
+		return status.Errorf(codes.PermissionDenied, e.Error())
+	}
+
+	// 设置上下文数据
+	ctx = context.WithValue(ctx, toolApi.ContextKeyClientIp, mi.Ip)
+	ctx = context.WithValue(ctx, toolApi.ContextKeyUserToken, mi.Token)
+	ctx = context.WithValue(ctx, toolApi.ContextKeyUserId, userId)
+	ctx = context.WithValue(ctx, toolApi.ContextKeyUserRole, userRole)
+
+	// 处理
+	e = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	gs, _ := status.FromError(e)
+	filelog.Info("流式接口", info.FullMethod, "客户端IP", mi.Ip, "用户id", userId, "响应编码", gs.Code(), "响应消息", gs.Message())
 
-	return status.Errorf(codes.Unimplemented, "暂时不能使用流式接口!")
+	return e
 }
 
 // Init 初始化
@@ -192,6 +242,13 @@ func Init() {
 	user.Register(s)
 	book.Register(s)
 	borrow.Register(s)
+	category.Register(s)
+	location.Register(s)
+	tier.Register(s)
+	overdue.Register(s)
+	fine.Register(s)
+	report.Register(s)
+	webhook.Register(s)
 
 	// 启动服务
 	netListen, e := net.Listen("tcp", fmt.Sprint(":", env.GrpcPort))
@@ -0,0 +1,150 @@
+package location
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/location"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	location.UnimplementedLocationServer
+}
+
+var sdb *pgxpool.Pool
+
+func checkInfoRequest(in *location.Info) error {
+	if in.GetCode() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要馆编码")
+	}
+	if in.GetName() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要名称")
+	}
+	if tool.ArrayIndex(in.GetState(), []string{"正常", "删除"}) == -1 {
+		return status.Errorf(codes.InvalidArgument, "状态无效")
+	}
+
+	return nil
+}
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	location.RegisterLocationServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+func (s *server) Add(ctx context.Context, in *location.Info) (*location.Empty, error) {
+	// 基本校验
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 保存入库
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameLocation, inText))
+	if e != nil {
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, status.Errorf(codes.InvalidArgument, "馆编码重复")
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "保存失败")
+	}
+
+	return &location.Empty{}, nil
+}
+
+func (s *server) Change(ctx context.Context, in *location.Info) (*location.Empty, error) {
+	// 基本校验
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 检查删除
+	if in.GetState() == "删除" {
+		if in.GetCode() == toolSql.DefaultLocationCode {
+			return nil, status.Errorf(codes.FailedPrecondition, "默认馆不能删除")
+		}
+
+		var totalCount int32
+		e = sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(j->>'total_count' as integer)), 0) from %s where j->>'location_code' = '%s'`, toolSql.TableNameBookStock, in.GetCode())).Scan(&totalCount)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if totalCount > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "馆内还有库存, 不能删除")
+		}
+	}
+
+	// 保存入库
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"name": "%s", "address": "%s", "state": "%s"}' where j->>'code' = '%s';`, toolSql.TableNameLocation, in.GetName(), in.GetAddress(), in.GetState(), in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "馆编码无效")
+	}
+
+	return &location.Empty{}, nil
+}
+
+func (s *server) Search(ctx context.Context, in *location.SearchRequest) (*location.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetKeyword() != "" {
+		sqlWhere = fmt.Sprintf(`%s and concat(j->>'code', j->>'name') like '%s'`,
+			sqlWhere,
+			fmt.Sprint(`%`, in.GetKeyword(), `%`),
+		)
+	}
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameLocation, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'code' offset %v limit %v`, toolSql.TableNameLocation, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*location.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info location.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := location.SearchResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
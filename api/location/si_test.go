@@ -0,0 +1,75 @@
+package location
+
+import (
+	"context"
+	"gs/proto/location"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc location.LocationClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = location.NewLocationClient(conn)
+
+	m.Run()
+}
+
+func TestAdd(t *testing.T) {
+	result, e := gc.Add(mc, &location.Info{
+		Code:    "东区分馆",
+		Name:    "东区分馆",
+		Address: "东区1号",
+		State:   "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestChange(t *testing.T) {
+	// 默认馆不能删除
+	_, e := gc.Change(mc, &location.Info{
+		Code:  "总馆",
+		Name:  "总馆",
+		State: "删除",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("默认馆不能删除", gs.Code(), gs.Message())
+	}
+}
+
+func TestSearch(t *testing.T) {
+	result, e := gc.Search(mc, &location.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
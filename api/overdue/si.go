@@ -0,0 +1,100 @@
+package overdue
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/overdue"
+	toolApi "gs/tool/api"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	overdue.UnimplementedOverdueServer
+}
+
+var sdb *pgxpool.Pool
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	overdue.RegisterOverdueServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+func (s *server) Search(ctx context.Context, in *overdue.SearchRequest) (*overdue.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	date := time.Now().Format("2006-01-02")
+	if in.GetDate() != "" {
+		_, e := time.Parse("2006-01-02", in.GetDate())
+		if e != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "计算日期无效")
+		}
+		date = in.GetDate()
+	}
+
+	// 读者只能查询自己的逾期
+	username := in.GetUsername()
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) == toolRole.Reader {
+		username = ctx.Value(toolApi.ContextKeyUserId).(string)
+	}
+
+	// 展开在借, 没有应还日期的不计逾期
+	sqlWhere := fmt.Sprintf(`coalesce(b->>'due_date', '') != '' and b->>'due_date' < '%s'`, date)
+	if username != "" {
+		sqlWhere = fmt.Sprintf(`%s and u.j->>'username' = '%s'`, sqlWhere, username)
+	}
+	if in.GetCode() != "" {
+		sqlWhere = fmt.Sprintf(`%s and b->>'code' = '%s'`, sqlWhere, in.GetCode())
+	}
+	sqlFrom := fmt.Sprintf(`%s as u, jsonb_array_elements(u.j->'books') as b`, toolSql.TableNameUserBorrow)
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, sqlFrom, sqlWhere)
+	sqlFull := fmt.Sprintf(`select jsonb_build_object(
+'username', u.j->>'username',
+'code', b->>'code',
+'count', b->'count',
+'barcodes', coalesce(b->'barcodes', '[]'),
+'location_code', b->>'location_code',
+'due_date', b->>'due_date',
+'overdue_days', cast('%s' as date) - cast(b->>'due_date' as date)
+) from %s where %s order by u.j->>'username', b->>'code', b->>'due_date' offset %v limit %v`, date, sqlFrom, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var infoArray []*overdue.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info overdue.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := overdue.SearchResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
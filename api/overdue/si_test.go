@@ -0,0 +1,68 @@
+package overdue
+
+import (
+	"context"
+	"gs/proto/overdue"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc overdue.OverdueClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = overdue.NewOverdueClient(conn)
+
+	m.Run()
+}
+
+func TestSearch(t *testing.T) {
+	// 计算日期无效
+	_, e := gc.Search(mc, &overdue.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Date:      "2024-13-01",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("计算日期无效", gs.Code(), gs.Message())
+	}
+
+	// 一年后全部在借都已逾期
+	result, e := gc.Search(mc, &overdue.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Username:  "测试",
+		Date:      time.Now().AddDate(1, 0, 0).Format("2006-01-02"),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, info := range result.GetInfoArray() {
+		if info.GetOverdueDays() < 1 {
+			t.Fatal("逾期天数", info)
+		}
+	}
+	t.Log(result)
+}
@@ -0,0 +1,162 @@
+package remind
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gs/filelog"
+	"gs/tool/env"
+	toolNotify "gs/tool/notify"
+	toolSql "gs/tool/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/robfig/cron/v3"
+)
+
+// 在借批次
+type lot struct {
+	Username     string `json:"username"`
+	Code         string `json:"code"`
+	LocationCode string `json:"location_code"`
+	DueDate      string `json:"due_date"`
+	Count        int32  `json:"-"`
+	Type         string `json:"type"` // 类型: [即将到期,逾期]
+	State        string `json:"state"`
+	DateText     string `json:"date_text"`
+}
+
+// Init 按提醒定时安排任务, 在 main.go 中调用一次
+func Init() {
+	cs := cron.New(cron.WithSeconds(), cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	_, e := cs.AddFunc(env.RemindSchedule, func() {
+		e := Run(context.Background())
+		if e != nil {
+			filelog.Warn("发送提醒失败", e.Error())
+		}
+	})
+	if e != nil {
+		filelog.Warn("安排提醒任务失败", e.Error())
+		return
+	}
+	cs.Start()
+}
+
+// Run 发送即将到期和逾期提醒
+//
+// 每个在借批次(用户, 图书编码, 借出馆, 应还日期)每种类型只提醒一次, 同一用户的提醒合并发送.
+// 发送记录和发送在同一事务中, 发送失败时回滚, 下次重试; 多个实例同时运行时不会重复发送.
+func Run(ctx context.Context) error {
+	sdb := toolSql.GetDb()
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	dueDays, _ := strconv.Atoi(env.RemindDueDays)
+	soonDate := now.AddDate(0, 0, dueDays).Format("2006-01-02")
+
+	// 查询到期日期不晚于提醒日期的在借
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select u.j->>'username', b->>'code', coalesce(b->>'location_code', ''), b->>'due_date', sum(cast(b->>'count' as integer)),
+coalesce(r.j->>'email', ''), coalesce(r.j->>'mobile_phone', '')
+from %s as u join %s as r on r.j->>'username' = u.j->>'username', jsonb_array_elements(u.j->'books') as b
+where coalesce(b->>'due_date', '') != '' and b->>'due_date' <= '%s' and cast(b->>'count' as integer) > 0
+group by 1, 2, 3, 4, 6, 7 order by 1, 4, 2`, toolSql.TableNameUserBorrow, toolSql.TableNameUser, soonDate))
+	if e != nil {
+		return e
+	}
+	recipientMap := make(map[string]toolNotify.Recipient)
+	lotMap := make(map[string][]*lot)
+	var usernames []string
+	for rows.Next() {
+		var v lot
+		var recipient toolNotify.Recipient
+		e = rows.Scan(&v.Username, &v.Code, &v.LocationCode, &v.DueDate, &v.Count, &recipient.Email, &recipient.MobilePhone)
+		if e != nil {
+			rows.Close()
+			return e
+		}
+		v.Type = "即将到期"
+		if v.DueDate < today {
+			v.Type = "逾期"
+		}
+		recipient.Username = v.Username
+		if _, exists := recipientMap[v.Username]; !exists {
+			usernames = append(usernames, v.Username)
+		}
+		recipientMap[v.Username] = recipient
+		lotMap[v.Username] = append(lotMap[v.Username], &v)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	// 按用户发送
+	for _, username := range usernames {
+		e = remindUser(ctx, recipientMap[username], lotMap[username], now)
+		if e != nil {
+			filelog.Warn("发送提醒失败", username, e.Error())
+		}
+	}
+	return nil
+}
+
+// 发送用户的提醒
+func remindUser(ctx context.Context, recipient toolNotify.Recipient, lots []*lot, now time.Time) error {
+	sdb := toolSql.GetDb()
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 记录没有提醒过的批次, 已经记录的跳过
+	var pendingLots []*lot
+	for _, v := range lots {
+		v.State = "已发送"
+		v.DateText = now.Format("2006-01-02T15:04:05")
+		jsonText, error := json.Marshal(v)
+		if error != nil {
+			e = error
+			return e
+		}
+		var inserted int
+		e = t.QueryRow(ctx, fmt.Sprintf(`insert into %s values('%s') ON CONFLICT ((j->>'username'), (j->>'code'), (j->>'location_code'), (j->>'due_date'), (j->>'type')) DO NOTHING returning 1`, toolSql.TableNameReminder, jsonText)).Scan(&inserted)
+		if e == pgx.ErrNoRows {
+			e = nil
+			continue
+		} else if e != nil {
+			return e
+		}
+		pendingLots = append(pendingLots, v)
+	}
+	if len(pendingLots) == 0 {
+		return nil
+	}
+
+	// 合并发送
+	var lines []string
+	for _, v := range pendingLots {
+		line := fmt.Sprintf("图书编码:%s 馆:%s 数量:%d 应还日期:%s", v.Code, v.LocationCode, v.Count, v.DueDate)
+		if v.Type == "逾期" {
+			line = fmt.Sprintf("%s (已逾期)", line)
+		}
+		lines = append(lines, line)
+	}
+	e = toolNotify.Notify(recipient, "图书到期提醒", fmt.Sprintf("%s, 您有以下在借图书即将到期或已经逾期, 请及时归还或续借:\n%s", recipient.Username, strings.Join(lines, "\n")))
+	if e == toolNotify.ErrNoAddress {
+		// 没有通知地址的记录为无法发送, 不再重试
+		_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "无法发送"}' where j->>'username' = '%s' and j->>'date_text' = '%s'`, toolSql.TableNameReminder, recipient.Username, now.Format("2006-01-02T15:04:05")))
+	}
+	return e
+}
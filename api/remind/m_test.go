@@ -0,0 +1,82 @@
+package remind
+
+import (
+	"context"
+	"fmt"
+	"gs/filelog"
+	"gs/tool/env"
+	toolNotify "gs/tool/notify"
+	toolSql "gs/tool/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	filelog.Init(env.SystemId)
+	defer filelog.Over()
+
+	// 创建postgres连接池
+	toolSql.Init()
+
+	m.Run()
+}
+
+func TestRun(t *testing.T) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer ctxCancel()
+	sdb := toolSql.GetDb()
+
+	// 通知写入临时文件
+	path := filepath.Join(t.TempDir(), "notify.txt")
+	toolNotify.SetNotifier(&toolNotify.FileNotifier{Path: path})
+	defer toolNotify.SetNotifier(nil)
+
+	// 添加今天到期的在借
+	username := fmt.Sprint("测试提醒-", uuid.New().String())
+	dueDate := time.Now().Format("2006-01-02")
+	_, e := sdb.Exec(ctx, fmt.Sprintf(`insert into %s values(jsonb_build_object('username', $1::text, 'state', '正常'))`, toolSql.TableNameUser), username)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = sdb.Exec(ctx, fmt.Sprintf(`insert into %s values(jsonb_build_object('username', $1::text, 'books', jsonb_build_array(jsonb_build_object('code', 'SN1', 'count', 1, 'location_code', $2::text, 'due_date', $3::text))))`, toolSql.TableNameUserBorrow), username, toolSql.DefaultLocationCode, dueDate)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer func() {
+		for _, tableName := range []string{toolSql.TableNameReminder, toolSql.TableNameUserBorrow, toolSql.TableNameUser} {
+			sdb.Exec(context.Background(), fmt.Sprintf(`delete from %s where j->>'username' = $1`, tableName), username)
+		}
+	}()
+
+	// 发送次数
+	sentCount := func() int {
+		data, e := os.ReadFile(path)
+		if e != nil && !os.IsNotExist(e) {
+			t.Fatal(e)
+		}
+		return strings.Count(string(data), fmt.Sprint("用户名: ", username, "\n"))
+	}
+
+	// 第一次发送
+	e = Run(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if sentCount() != 1 {
+		t.Fatal("第一次发送", sentCount())
+	}
+
+	// 再次运行不重复发送
+	e = Run(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if sentCount() != 1 {
+		t.Fatal("重复发送", sentCount())
+	}
+}
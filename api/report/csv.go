@@ -0,0 +1,96 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"gs/proto/report"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 报表转为CSV行, 第一行为表头
+func reportRecords(ctx context.Context, in *report.ExportRequest) ([][]string, error) {
+	itoa := func(v int32) string { return strconv.Itoa(int(v)) }
+	ftoa := func(v float64) string { return strconv.FormatFloat(v, 'f', 4, 64) }
+
+	var records [][]string
+	switch in.GetReport() {
+	case "TopBook":
+		result, e := topBook(ctx, in.GetRequest())
+		if e != nil {
+			return nil, e
+		}
+		records = append(records, []string{"图书编码", "名称", "借出数量", "借阅人数"})
+		for _, v := range result.GetInfoArray() {
+			records = append(records, []string{v.GetCode(), v.GetName(), itoa(v.GetBorrowCount()), itoa(v.GetBorrowerCount())})
+		}
+	case "ActiveBorrower":
+		result, e := activeBorrower(ctx, in.GetRequest())
+		if e != nil {
+			return nil, e
+		}
+		records = append(records, []string{"用户名", "借出数量", "借出图书种数"})
+		for _, v := range result.GetInfoArray() {
+			records = append(records, []string{v.GetUsername(), itoa(v.GetBorrowCount()), itoa(v.GetTitleCount())})
+		}
+	case "DailyCirculation":
+		result, e := dailyCirculation(ctx, in.GetRequest())
+		if e != nil {
+			return nil, e
+		}
+		records = append(records, []string{"日期", "借出数量", "归还数量", "续借数量", "遗失数量", "损坏数量"})
+		for _, v := range result.GetInfoArray() {
+			records = append(records, []string{v.GetDate(), itoa(v.GetOutCount()), itoa(v.GetInCount()), itoa(v.GetRenewCount()), itoa(v.GetLostCount()), itoa(v.GetDamagedCount())})
+		}
+	case "Utilization":
+		result, e := utilization(ctx, in.GetRequest())
+		if e != nil {
+			return nil, e
+		}
+		records = append(records, []string{"图书编码", "名称", "库存数量", "借出数量", "利用率"})
+		records = append(records, []string{"合计", "", itoa(result.GetTotalCount()), itoa(result.GetBorrowCount()), ftoa(result.GetUtilization())})
+		for _, v := range result.GetInfoArray() {
+			records = append(records, []string{v.GetCode(), v.GetName(), itoa(v.GetTotalCount()), itoa(v.GetBorrowCount()), ftoa(v.GetUtilization())})
+		}
+	case "OverdueRate":
+		result, e := overdueRate(ctx, in.GetRequest())
+		if e != nil {
+			return nil, e
+		}
+		records = append(records, []string{"归还数量", "逾期归还数量", "逾期归还率", "当前在借数量", "当前逾期数量", "当前逾期率"})
+		records = append(records, []string{itoa(result.GetReturnCount()), itoa(result.GetLateReturnCount()), ftoa(result.GetLateReturnRate()), itoa(result.GetLoanCount()), itoa(result.GetOverdueLoanCount()), ftoa(result.GetOverdueLoanRate())})
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "报表无效")
+	}
+	return records, nil
+}
+
+func (s *server) Export(ctx context.Context, in *report.ExportRequest) (*report.ExportResponse, error) {
+	if in.GetRequest() == nil {
+		in.Request = &report.ReportRequest{}
+	}
+	records, e := reportRecords(ctx, in)
+	if e != nil {
+		return nil, e
+	}
+
+	// UTF-8 BOM, 便于表格软件识别中文
+	var buffer bytes.Buffer
+	buffer.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(&buffer)
+	e = w.WriteAll(records)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &report.ExportResponse{
+		FileName:    fmt.Sprintf("%s-%s.csv", in.GetReport(), time.Now().Format("20060102150405")),
+		ContentType: "text/csv",
+		Content:     buffer.Bytes(),
+	}, nil
+}
@@ -0,0 +1,257 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/report"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	report.UnimplementedReportServer
+}
+
+var sdb *pgxpool.Pool
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	report.RegisterReportServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+// 日期范围, 返回开始日期和结束日期的下一天, 为空时为最近30天
+func dateRange(in *report.ReportRequest) (time.Time, time.Time, error) {
+	now := time.Now()
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if in.GetDateEnd() != "" {
+		v, e := time.ParseInLocation("2006-01-02", in.GetDateEnd(), time.Local)
+		if e != nil {
+			return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "结束日期无效")
+		}
+		end = v
+	}
+	start := end.AddDate(0, 0, -29)
+	if in.GetDateStart() != "" {
+		v, e := time.ParseInLocation("2006-01-02", in.GetDateStart(), time.Local)
+		if e != nil {
+			return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "开始日期无效")
+		}
+		start = v
+	}
+	if start.After(end) {
+		return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "开始日期不能晚于结束日期")
+	}
+	if end.Sub(start) > 366*24*time.Hour {
+		return time.Time{}, time.Time{}, status.Errorf(codes.InvalidArgument, "日期范围不能超过1年")
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
+
+// 借还记录日期条件
+func dateWhere(in *report.ReportRequest) (string, error) {
+	start, end, e := dateRange(in)
+	if e != nil {
+		return "", e
+	}
+	return fmt.Sprintf(`o.j->>'date_text' >= '%s' and o.j->>'date_text' < '%s'`, start.Format("2006-01-02"), end.Format("2006-01-02")), nil
+}
+
+// 返回数量
+func limit(in *report.ReportRequest) (int32, error) {
+	if in.GetLimit() < 0 || in.GetLimit() > 1000 {
+		return 0, status.Errorf(codes.InvalidArgument, "返回数量必须在0到1000以内")
+	}
+	if in.GetLimit() == 0 {
+		return 20, nil
+	}
+	return in.GetLimit(), nil
+}
+
+// 比例, 分母为0时为0
+func rate(numerator, denominator int32) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return float64(numerator) / float64(denominator)
+}
+
+func topBook(ctx context.Context, in *report.ReportRequest) (*report.TopBookResponse, error) {
+	sqlWhere, e := dateWhere(in)
+	if e != nil {
+		return nil, e
+	}
+	limitCount, e := limit(in)
+	if e != nil {
+		return nil, e
+	}
+
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select b->>'code', coalesce((select k.j->>'name' from %s as k where k.j->>'code' = b->>'code'), ''), sum(cast(b->>'count' as integer)), count(distinct o.j->>'username')
+from %s as o, jsonb_array_elements(o.j->'books') as b where o.j->>'type' = '借出' and %s
+group by b->>'code' order by 3 desc, 1 limit %d`, toolSql.TableNameBook, toolSql.TableNameBorrowOutIn, sqlWhere, limitCount))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var result report.TopBookResponse
+	for rows.Next() {
+		var info report.TopBookInfo
+		e = rows.Scan(&info.Code, &info.Name, &info.BorrowCount, &info.BorrowerCount)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		result.InfoArray = append(result.InfoArray, &info)
+	}
+	return &result, nil
+}
+
+func activeBorrower(ctx context.Context, in *report.ReportRequest) (*report.ActiveBorrowerResponse, error) {
+	sqlWhere, e := dateWhere(in)
+	if e != nil {
+		return nil, e
+	}
+	limitCount, e := limit(in)
+	if e != nil {
+		return nil, e
+	}
+
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select o.j->>'username', sum(cast(b->>'count' as integer)), count(distinct b->>'code')
+from %s as o, jsonb_array_elements(o.j->'books') as b where o.j->>'type' = '借出' and %s
+group by o.j->>'username' order by 2 desc, 1 limit %d`, toolSql.TableNameBorrowOutIn, sqlWhere, limitCount))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var result report.ActiveBorrowerResponse
+	for rows.Next() {
+		var info report.ActiveBorrowerInfo
+		e = rows.Scan(&info.Username, &info.BorrowCount, &info.TitleCount)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		result.InfoArray = append(result.InfoArray, &info)
+	}
+	return &result, nil
+}
+
+func dailyCirculation(ctx context.Context, in *report.ReportRequest) (*report.DailyCirculationResponse, error) {
+	start, end, e := dateRange(in)
+	if e != nil {
+		return nil, e
+	}
+	sqlWhere, e := dateWhere(in)
+	if e != nil {
+		return nil, e
+	}
+
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select to_char(d, 'YYYY-MM-DD'),
+coalesce(sum(r.count) filter (where r.type = '借出'), 0),
+coalesce(sum(r.count) filter (where r.type = '归还'), 0),
+coalesce(sum(r.count) filter (where r.type = '续借'), 0),
+coalesce(sum(r.count) filter (where r.type = '遗失'), 0),
+coalesce(sum(r.count) filter (where r.type = '损坏'), 0)
+from generate_series(cast('%s' as date), cast('%s' as date), interval '1 day') as d
+left join (select substr(o.j->>'date_text', 1, 10) as day, o.j->>'type' as type, cast(b->>'count' as integer) as count from %s as o, jsonb_array_elements(o.j->'books') as b where %s) as r
+on r.day = to_char(d, 'YYYY-MM-DD')
+group by d order by d`, start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02"), toolSql.TableNameBorrowOutIn, sqlWhere))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var result report.DailyCirculationResponse
+	for rows.Next() {
+		var info report.DailyCirculationInfo
+		e = rows.Scan(&info.Date, &info.OutCount, &info.InCount, &info.RenewCount, &info.LostCount, &info.DamagedCount)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		result.InfoArray = append(result.InfoArray, &info)
+	}
+	return &result, nil
+}
+
+func utilization(ctx context.Context, in *report.ReportRequest) (*report.UtilizationResponse, error) {
+	limitCount, e := limit(in)
+	if e != nil {
+		return nil, e
+	}
+
+	var result report.UtilizationResponse
+	e = sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(j->>'total_count' as integer)), 0), coalesce(sum(cast(j->>'borrow_count' as integer)), 0) from %s where j->>'state' = '正常'`, toolSql.TableNameBook)).Scan(&result.TotalCount, &result.BorrowCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	result.Utilization = rate(result.BorrowCount, result.TotalCount)
+
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select j->>'code', coalesce(j->>'name', ''), cast(j->>'total_count' as integer), cast(j->>'borrow_count' as integer)
+from %s where j->>'state' = '正常' and cast(j->>'total_count' as integer) > 0
+order by cast(j->>'borrow_count' as float) / cast(j->>'total_count' as integer) desc, j->>'code' limit %d`, toolSql.TableNameBook, limitCount))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var info report.UtilizationInfo
+		e = rows.Scan(&info.Code, &info.Name, &info.TotalCount, &info.BorrowCount)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		info.Utilization = rate(info.BorrowCount, info.TotalCount)
+		result.InfoArray = append(result.InfoArray, &info)
+	}
+	return &result, nil
+}
+
+func overdueRate(ctx context.Context, in *report.ReportRequest) (*report.OverdueRateResponse, error) {
+	sqlWhere, e := dateWhere(in)
+	if e != nil {
+		return nil, e
+	}
+
+	var result report.OverdueRateResponse
+	e = sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(b->>'count' as integer)), 0),
+coalesce(sum(cast(b->>'count' as integer)) filter (where coalesce(b->>'due_date', '') != '' and b->>'due_date' < substr(o.j->>'date_text', 1, 10)), 0)
+from %s as o, jsonb_array_elements(o.j->'books') as b where o.j->>'type' = '归还' and %s`, toolSql.TableNameBorrowOutIn, sqlWhere)).Scan(&result.ReturnCount, &result.LateReturnCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	result.LateReturnRate = rate(result.LateReturnCount, result.ReturnCount)
+
+	today := time.Now().Format("2006-01-02")
+	e = sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(b->>'count' as integer)), 0),
+coalesce(sum(cast(b->>'count' as integer)) filter (where coalesce(b->>'due_date', '') != '' and b->>'due_date' < '%s'), 0)
+from %s as u, jsonb_array_elements(u.j->'books') as b`, today, toolSql.TableNameUserBorrow)).Scan(&result.LoanCount, &result.OverdueLoanCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	result.OverdueLoanRate = rate(result.OverdueLoanCount, result.LoanCount)
+
+	return &result, nil
+}
+
+func (s *server) TopBook(ctx context.Context, in *report.ReportRequest) (*report.TopBookResponse, error) {
+	return topBook(ctx, in)
+}
+
+func (s *server) ActiveBorrower(ctx context.Context, in *report.ReportRequest) (*report.ActiveBorrowerResponse, error) {
+	return activeBorrower(ctx, in)
+}
+
+func (s *server) DailyCirculation(ctx context.Context, in *report.ReportRequest) (*report.DailyCirculationResponse, error) {
+	return dailyCirculation(ctx, in)
+}
+
+func (s *server) Utilization(ctx context.Context, in *report.ReportRequest) (*report.UtilizationResponse, error) {
+	return utilization(ctx, in)
+}
+
+func (s *server) OverdueRate(ctx context.Context, in *report.ReportRequest) (*report.OverdueRateResponse, error) {
+	return overdueRate(ctx, in)
+}
@@ -0,0 +1,140 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"gs/proto/report"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc report.ReportClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = report.NewReportClient(conn)
+
+	m.Run()
+}
+
+func TestDateRange(t *testing.T) {
+	// 开始日期晚于结束日期
+	_, e := gc.TopBook(mc, &report.ReportRequest{
+		DateStart: "2024-08-13",
+		DateEnd:   "2024-08-01",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("开始日期晚于结束日期", gs.Code(), gs.Message())
+	}
+
+	// 返回数量过多
+	_, e = gc.ActiveBorrower(mc, &report.ReportRequest{Limit: 1001})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("返回数量过多", gs.Code(), gs.Message())
+	}
+}
+
+func TestTopBook(t *testing.T) {
+	result, e := gc.TopBook(mc, &report.ReportRequest{Limit: 5})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.GetInfoArray()) > 5 {
+		t.Fatal("返回数量", len(result.GetInfoArray()))
+	}
+	t.Log(result)
+}
+
+func TestActiveBorrower(t *testing.T) {
+	result, e := gc.ActiveBorrower(mc, &report.ReportRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestDailyCirculation(t *testing.T) {
+	// 没有借还的日期也返回
+	result, e := gc.DailyCirculation(mc, &report.ReportRequest{
+		DateStart: "2024-08-01",
+		DateEnd:   "2024-08-07",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.GetInfoArray()) != 7 || result.GetInfoArray()[0].GetDate() != "2024-08-01" {
+		t.Fatal("每日借还", result)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	result, e := gc.Utilization(mc, &report.ReportRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetBorrowCount() > result.GetTotalCount() {
+		t.Fatal("借出数量超过库存数量", result)
+	}
+	t.Log(result)
+}
+
+func TestOverdueRate(t *testing.T) {
+	result, e := gc.OverdueRate(mc, &report.ReportRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetLateReturnCount() > result.GetReturnCount() || result.GetOverdueLoanCount() > result.GetLoanCount() {
+		t.Fatal("逾期率", result)
+	}
+	t.Log(result)
+}
+
+func TestExport(t *testing.T) {
+	// 报表无效
+	_, e := gc.Export(mc, &report.ExportRequest{Report: "无效"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("报表无效", gs.Code(), gs.Message())
+	}
+
+	result, e := gc.Export(mc, &report.ExportRequest{Report: "DailyCirculation", Request: &report.ReportRequest{
+		DateStart: "2024-08-01",
+		DateEnd:   "2024-08-07",
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetContentType() != "text/csv" || !bytes.HasPrefix(result.GetContent(), []byte("\xEF\xBB\xBF日期")) {
+		t.Fatal("导出", result.GetFileName(), string(result.GetContent()))
+	}
+	t.Log(string(result.GetContent()))
+}
@@ -0,0 +1,154 @@
+package tier
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/tier"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	tier.UnimplementedTierServer
+}
+
+var sdb *pgxpool.Pool
+
+func checkInfoRequest(in *tier.Info) error {
+	if in.GetCode() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要等级编码")
+	}
+	if in.GetName() == "" {
+		return status.Errorf(codes.InvalidArgument, "需要名称")
+	}
+	if in.GetMaxLoanCount() < 1 || in.GetMaxTitleCount() < 1 || in.GetLoanDays() < 1 {
+		return status.Errorf(codes.InvalidArgument, "最多在借数量, 每种图书最多在借数量, 借期天数必须大于0")
+	}
+	if in.GetFinePerDay() < 0 || in.GetFineCap() < 0 || in.GetFineBlockAmount() < 0 {
+		return status.Errorf(codes.InvalidArgument, "罚款金额不能小于0")
+	}
+	if in.GetMaxRenewCount() < 0 {
+		return status.Errorf(codes.InvalidArgument, "最多续借次数不能小于0")
+	}
+	if tool.ArrayIndex(in.GetState(), []string{"正常", "删除"}) == -1 {
+		return status.Errorf(codes.InvalidArgument, "状态无效")
+	}
+
+	return nil
+}
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	tier.RegisterTierServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+func (s *server) Add(ctx context.Context, in *tier.Info) (*tier.Empty, error) {
+	// 基本校验
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 保存入库
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameTier, inText))
+	if e != nil {
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, status.Errorf(codes.InvalidArgument, "等级编码重复")
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "保存失败")
+	}
+
+	return &tier.Empty{}, nil
+}
+
+func (s *server) Change(ctx context.Context, in *tier.Info) (*tier.Empty, error) {
+	// 基本校验
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 检查删除
+	if in.GetState() == "删除" {
+		if in.GetCode() == toolSql.DefaultTierCode {
+			return nil, status.Errorf(codes.FailedPrecondition, "默认等级不能删除")
+		}
+
+		var count int
+		e = sdb.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'tier_code' = '%s' and j->>'state' != '删除'`, toolSql.TableNameUser, in.GetCode())).Scan(&count)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if count > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "还有用户使用该等级, 不能删除")
+		}
+	}
+
+	// 保存入库
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`update %s set j = '%s' where j->>'code' = '%s';`, toolSql.TableNameTier, inText, in.GetCode()))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "等级编码无效")
+	}
+
+	return &tier.Empty{}, nil
+}
+
+func (s *server) Search(ctx context.Context, in *tier.SearchRequest) (*tier.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameTier, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'code' offset %v limit %v`, toolSql.TableNameTier, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	var infoArray []*tier.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info tier.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := tier.SearchResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
@@ -0,0 +1,94 @@
+package tier
+
+import (
+	"context"
+	"gs/proto/tier"
+	toolApi "gs/tool/api"
+	"log"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc tier.TierClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = tier.NewTierClient(conn)
+
+	m.Run()
+}
+
+func TestAdd(t *testing.T) {
+	// 基本校验
+	_, e := gc.Add(mc, &tier.Info{
+		Code:  "学生",
+		Name:  "学生",
+		State: "正常",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("基本校验", gs.Code(), gs.Message())
+	}
+
+	result, e := gc.Add(mc, &tier.Info{
+		Code:          "学生",
+		Name:          "学生",
+		MaxLoanCount:  5,
+		MaxTitleCount: 1,
+		LoanDays:      30,
+		State:         "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestChange(t *testing.T) {
+	// 默认等级不能删除
+	_, e := gc.Change(mc, &tier.Info{
+		Code:          "普通",
+		Name:          "普通",
+		MaxLoanCount:  20,
+		MaxTitleCount: 5,
+		LoanDays:      30,
+		State:         "删除",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("默认等级不能删除", gs.Code(), gs.Message())
+	}
+}
+
+func TestSearch(t *testing.T) {
+	result, e := gc.Search(mc, &tier.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
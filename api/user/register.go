@@ -0,0 +1,315 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/user"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolMail "gs/tool/mail"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 时间格式
+	timeLayout = "2006-01-02T15:04:05"
+	// 验证码有效期
+	verifyExpire = 15 * time.Minute
+	// 重发间隔
+	verifyResendInterval = time.Minute
+	// 最多发送次数
+	verifyMaxSendCount = 5
+	// 最多错误次数
+	verifyMaxTryCount = 5
+)
+
+// 生成6位数字验证码
+func newVerifyCode() (string, error) {
+	n, e := rand.Int(rand.Reader, big.NewInt(1000000))
+	if e != nil {
+		return "", e
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// 发送验证码邮件
+func sendVerifyCode(info *user.VerifyInfo) error {
+	body := fmt.Sprintf("%s 您好, 您的验证码是 %s, %d分钟内有效.", info.GetUsername(), info.GetCode(), int(verifyExpire.Minutes()))
+	return toolMail.Send(info.GetEmail(), "图书服务注册验证码", body)
+}
+
+// 解析时间, 无效时返回零值
+func parseTime(text string) time.Time {
+	v, _ := time.ParseInLocation(timeLayout, text, time.Local)
+	return v
+}
+
+func (s *server) Register(ctx context.Context, in *user.RegisterRequest) (*user.Empty, error) {
+	// 基本校验, 公开接口的值都使用参数传递
+	if !tool.UsernameOk(in.GetUsername()) {
+		return nil, status.Errorf(codes.InvalidArgument, "用户名无效")
+	}
+	if !tool.EmailOk(in.GetEmail()) {
+		return nil, status.Errorf(codes.InvalidArgument, "电子邮箱无效")
+	}
+	code, e := newVerifyCode()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 事务提交后再发送验证码, 避免给未创建的用户发送
+	verifyInfo, e := register(ctx, in, code)
+	if e != nil {
+		return nil, e
+	}
+	e = sendVerifyCode(verifyInfo)
+	if e != nil {
+		filelog.Warn("发送验证码失败", in.GetUsername(), e.Error())
+		return nil, status.Errorf(codes.Unavailable, "验证码发送失败")
+	}
+
+	return &user.Empty{}, nil
+}
+
+// 创建待验证用户并保存验证码
+func register(ctx context.Context, in *user.RegisterRequest, code string) (*user.VerifyInfo, error) {
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		}
+	}()
+
+	// 清理过期的待验证用户, 释放用户名和电子邮箱
+	now := time.Now()
+	_, e = t.Exec(ctx, fmt.Sprintf(`with v as (delete from %s where (j->>'username' = $1 or j->>'email' = $2) and j->>'expire_time_text' < $3 returning j->>'username' as username)
+delete from %s where j->>'state' = '待验证' and j->>'username' in (select username from v);`,
+		toolSql.TableNameUserVerify, toolSql.TableNameUser), in.GetUsername(), in.GetEmail(), now.Format(timeLayout))
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 创建待验证用户
+	info := user.Info{
+		Username:    in.GetUsername(),
+		State:       "待验证",
+		DisplayName: in.GetDisplayName(),
+		Email:       in.GetEmail(),
+		TierCode:    toolSql.DefaultTierCode,
+		Role:        toolRole.Reader,
+	}
+	infoText, _ := toolApi.ProtoToJson(&info)
+	_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s values($1);`, toolSql.TableNameUser), infoText)
+	if e != nil {
+		// 唯一性
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, duplicateError(e)
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 保存验证码
+	verifyInfo := user.VerifyInfo{
+		Username:       in.GetUsername(),
+		Email:          in.GetEmail(),
+		Code:           code,
+		ExpireTimeText: now.Add(verifyExpire).Format(timeLayout),
+		SendTimeText:   now.Format(timeLayout),
+		SendCount:      1,
+	}
+	verifyText, _ := toolApi.ProtoToJson(&verifyInfo)
+	_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s values($1) ON CONFLICT ((j->'username')) DO UPDATE SET j = EXCLUDED.j;`, toolSql.TableNameUserVerify), verifyText)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 提交事务
+	filelog.Debug("提交事务")
+	e = t.Commit(ctx)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &verifyInfo, nil
+}
+
+// 查询邮箱验证
+func getVerifyInfo(ctx context.Context, q toolSql.Querier, username string, forUpdate bool) (*user.VerifyInfo, error) {
+	sql := fmt.Sprintf(`select j from %s where j->>'username' = $1`, toolSql.TableNameUserVerify)
+	if forUpdate {
+		sql += ` FOR UPDATE`
+	}
+
+	var jsonText string
+	e := q.QueryRow(ctx, sql, username).Scan(&jsonText)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.InvalidArgument, "用户名无效或不需要验证")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	var info user.VerifyInfo
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	return &info, nil
+}
+
+func (s *server) VerifyEmail(ctx context.Context, in *user.VerifyEmailRequest) (*user.Empty, error) {
+	// 基本校验
+	if in.GetUsername() == "" || in.GetCode() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要用户名和验证码")
+	}
+	if !tool.UsernameOk(in.GetUsername()) {
+		return nil, status.Errorf(codes.InvalidArgument, "用户名无效")
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 检查验证码, 锁定后检查并增加错误次数, 避免并发猜测绕过次数限制
+	verifyInfo, error := getVerifyInfo(ctx, t, in.GetUsername(), true)
+	if error != nil {
+		e = error
+		return nil, e
+	}
+	if time.Now().After(parseTime(verifyInfo.GetExpireTimeText())) {
+		e = fmt.Errorf("验证码已过期, 请重发验证码")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+	if verifyInfo.GetTryCount() >= verifyMaxTryCount {
+		e = fmt.Errorf("验证码错误次数过多, 请重发验证码")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+	if verifyInfo.GetCode() != in.GetCode() {
+		// 提交错误次数
+		_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('try_count', coalesce(cast(j->>'try_count' as integer), 0) + 1) where j->>'username' = $1;`, toolSql.TableNameUserVerify), in.GetUsername())
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "验证码错误")
+	}
+
+	// 激活用户
+	ct, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "正常"}' where j->>'username' = $1 and j->>'state' = '待验证';`, toolSql.TableNameUser), in.GetUsername())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		e = fmt.Errorf("用户不是待验证状态")
+		return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+	}
+
+	// 删除验证码
+	_, e = t.Exec(ctx, fmt.Sprintf(`delete from %s where j->>'username' = $1;`, toolSql.TableNameUserVerify), in.GetUsername())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return &user.Empty{}, nil
+}
+
+func (s *server) ResendVerifyCode(ctx context.Context, in *user.ResendVerifyCodeRequest) (*user.Empty, error) {
+	// 基本校验
+	if !tool.UsernameOk(in.GetUsername()) {
+		return nil, status.Errorf(codes.InvalidArgument, "用户名无效")
+	}
+	code, e := newVerifyCode()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 事务提交后再发送验证码
+	verifyInfo, e := resendVerifyCode(ctx, in.GetUsername(), code)
+	if e != nil {
+		return nil, e
+	}
+	e = sendVerifyCode(verifyInfo)
+	if e != nil {
+		filelog.Warn("发送验证码失败", in.GetUsername(), e.Error())
+		return nil, status.Errorf(codes.Unavailable, "验证码发送失败")
+	}
+
+	return &user.Empty{}, nil
+}
+
+// 检查发送限制并更新验证码
+func resendVerifyCode(ctx context.Context, username string, code string) (*user.VerifyInfo, error) {
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		}
+	}()
+
+	// 检查发送限制
+	verifyInfo, error := getVerifyInfo(ctx, t, username, true)
+	if error != nil {
+		e = error
+		return nil, e
+	}
+	now := time.Now()
+	if verifyInfo.GetSendCount() >= verifyMaxSendCount {
+		e = fmt.Errorf("验证码发送次数过多")
+		return nil, status.Errorf(codes.ResourceExhausted, e.Error())
+	}
+	if now.Sub(parseTime(verifyInfo.GetSendTimeText())) < verifyResendInterval {
+		e = fmt.Errorf("验证码发送过于频繁, 请稍后再试")
+		return nil, status.Errorf(codes.ResourceExhausted, e.Error())
+	}
+
+	// 更新验证码
+	verifyInfo.Code = code
+	verifyInfo.ExpireTimeText = now.Add(verifyExpire).Format(timeLayout)
+	verifyInfo.SendTimeText = now.Format(timeLayout)
+	verifyInfo.SendCount++
+	verifyInfo.TryCount = 0
+	verifyText, _ := toolApi.ProtoToJson(verifyInfo)
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = $1 where j->>'username' = $2;`, toolSql.TableNameUserVerify), verifyText, username)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 提交事务
+	filelog.Debug("提交事务")
+	e = t.Commit(ctx)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	return verifyInfo, nil
+}
@@ -3,11 +3,16 @@ package user
 import (
 	"context"
 	"fmt"
+	"gs/filelog"
 	"gs/proto/user"
 	"gs/tool"
 	toolApi "gs/tool/api"
 	toolCache "gs/tool/cache"
+	toolIdempotency "gs/tool/idempotency"
+	toolOutbox "gs/tool/outbox"
+	toolRole "gs/tool/role"
 	toolSql "gs/tool/sql"
+	toolTier "gs/tool/tier"
 	"strings"
 
 	"github.com/google/uuid"
@@ -29,13 +34,47 @@ func checkInfoRequest(in *user.Info) error {
 	if in.GetUsername() == "" {
 		return status.Errorf(codes.InvalidArgument, "需要用户名")
 	}
-	if tool.ArrayIndex(in.GetState(), []string{"正常", "删除"}) == -1 {
+	if tool.ArrayIndex(in.GetState(), []string{"正常", "停用", "删除"}) == -1 {
 		return status.Errorf(codes.InvalidArgument, "状态无效")
 	}
+	if in.GetEmail() != "" && !tool.EmailOk(in.GetEmail()) {
+		return status.Errorf(codes.InvalidArgument, "电子邮箱无效")
+	}
+	if in.GetMobilePhone() != "" && !tool.MobilePhoneOk(in.GetMobilePhone()) {
+		return status.Errorf(codes.InvalidArgument, "手机号码无效")
+	}
+	if !toolRole.Ok(in.GetRole()) {
+		return status.Errorf(codes.InvalidArgument, "角色无效")
+	}
+
+	return nil
+}
+
+// 检查会员等级
+func checkTierCode(ctx context.Context, in *user.Info) error {
+	var count int
+	e := sdb.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s' and j->>'state' = '正常'`, toolSql.TableNameTier, in.GetTierCode())).Scan(&count)
+	if e != nil {
+		return status.Errorf(codes.Internal, e.Error())
+	}
+	if count == 0 {
+		return status.Errorf(codes.InvalidArgument, "会员等级无效")
+	}
 
 	return nil
 }
 
+// 唯一性错误
+func duplicateError(e error) error {
+	if strings.Contains(e.Error(), fmt.Sprint("iu_", toolSql.TableNameUser, "_email")) {
+		return status.Errorf(codes.InvalidArgument, "电子邮箱重复")
+	}
+	if strings.Contains(e.Error(), fmt.Sprint("iu_", toolSql.TableNameUser, "_card_number")) {
+		return status.Errorf(codes.InvalidArgument, "借书证号重复")
+	}
+	return status.Errorf(codes.InvalidArgument, "用户名重复")
+}
+
 // Register 注册服务, 传递公共资源
 func Register(s grpc.ServiceRegistrar) {
 	user.RegisterUserServer(s, &server{})
@@ -50,38 +89,186 @@ func (s *server) Add(ctx context.Context, in *user.Info) (*user.Empty, error) {
 		return nil, e
 	}
 
+	// 会员等级和角色为空时使用默认值
+	if in.GetTierCode() == "" {
+		in.TierCode = toolSql.DefaultTierCode
+	}
+	in.Role = toolRole.Name(in.GetRole())
+	e = checkTierCode(ctx, in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 上下文中获取用户名
+	username := ctx.Value(toolApi.ContextKeyUserId).(string)
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 幂等键: 保留期内重复请求返回原来的结果
+	idempotencyKey, error := toolIdempotency.GetKey(ctx)
+	if error != nil {
+		e = error
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+	if idempotencyKey != "" {
+		response, error := toolIdempotency.Check(ctx, t, idempotencyKey, username, in)
+		if error == toolIdempotency.ErrMismatch {
+			e = error
+			return nil, status.Errorf(codes.InvalidArgument, e.Error())
+		} else if error != nil {
+			e = error
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if response != "" {
+			var result user.Empty
+			e = toolApi.JsonToProto(response, &result)
+			if e != nil {
+				return nil, status.Errorf(codes.Internal, e.Error())
+			}
+			return &result, nil
+		}
+	}
+
 	// 保存入库
 	inText, _ := toolApi.ProtoToJson(in)
-	ct, e := sdb.Exec(context.Background(), fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameUser, inText))
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameUser, inText))
 	if e != nil {
-		// 用户名重复
+		// 唯一性
 		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
-			return nil, status.Errorf(codes.InvalidArgument, "用户名重复")
+			return nil, duplicateError(e)
 		}
 
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
 	if ct.RowsAffected() == 0 {
-		return nil, status.Errorf(codes.InvalidArgument, "保存失败")
+		e = fmt.Errorf("保存失败")
+		return nil, status.Errorf(codes.InvalidArgument, e.Error())
+	}
+
+	// 保存幂等键结果
+	if idempotencyKey != "" {
+		e = toolIdempotency.Save(ctx, t, idempotencyKey, username, &user.Empty{})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
 	}
 
 	return &user.Empty{}, nil
 }
 
-func (s *server) Change(ctx context.Context, in *user.Info) (*user.Empty, error) {
+func (s *server) Change(ctx context.Context, request *user.ChangeRequest) (*user.Empty, error) {
+	in := request.GetInfo()
+	if in == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "需要用户资料")
+	}
+
 	// 基本校验
 	e := checkInfoRequest(in)
 	if e != nil {
 		return nil, e
 	}
 
-	// 保存入库
-	ct, e := sdb.Exec(context.Background(), fmt.Sprintf(`update %s set j = jsonb_set(j, '{state}', '"%s"') where j->>'username' = '%s';`, toolSql.TableNameUser, in.GetState(), in.GetUsername()))
+	// 会员等级为空时不修改
+	if in.GetTierCode() != "" {
+		e = checkTierCode(ctx, in)
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	// 准备事务
+	t, e := sdb.BeginTx(ctx, pgx.TxOptions{})
 	if e != nil {
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
-	if ct.RowsAffected() == 0 {
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 锁定用户
+	var oldState string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select coalesce(j->>'state', '') from %s where j->>'username' = $1 FOR UPDATE;`, toolSql.TableNameUser), in.GetUsername()).Scan(&oldState)
+	if e == pgx.ErrNoRows {
 		return nil, status.Errorf(codes.InvalidArgument, "用户名无效")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 有在借图书时不能删除, 在锁定用户后检查, 避免与借出并发
+	if in.GetState() == "删除" && !request.GetForce() {
+		var count int
+		e = t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'username' = $1`, toolSql.TableNameUserBorrow), in.GetUsername()).Scan(&count)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		if count > 0 {
+			e = fmt.Errorf("用户还有在借图书, 不能删除")
+			return nil, status.Errorf(codes.FailedPrecondition, e.Error())
+		}
+	}
+
+	// 保存入库: 只合并请求中提供的字段, 值使用参数传递
+	fieldMap := map[string]string{
+		"display_name": in.GetDisplayName(),
+		"email":        in.GetEmail(),
+		"mobile_phone": in.GetMobilePhone(),
+		"card_number":  in.GetCardNumber(),
+		"notes":        in.GetNotes(),
+		"tier_code":    in.GetTierCode(),
+		"role":         in.GetRole(),
+	}
+	sqlPairs := []string{`'state', $1::text`}
+	args := []any{in.GetState()}
+	for _, name := range []string{"display_name", "email", "mobile_phone", "card_number", "notes", "tier_code", "role"} {
+		if fieldMap[name] == "" {
+			continue
+		}
+		args = append(args, fieldMap[name])
+		sqlPairs = append(sqlPairs, fmt.Sprintf(`'%s', $%d::text`, name, len(args)))
+	}
+	args = append(args, in.GetUsername())
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object(%s) where j->>'username' = $%d;`, toolSql.TableNameUser, strings.Join(sqlPairs, ", "), len(args)), args...)
+	if e != nil {
+		// 唯一性
+		if strings.HasPrefix(e.Error(), "ERROR: duplicate key value") {
+			return nil, duplicateError(e)
+		}
+
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 状态变化时记录事件
+	if in.GetState() != oldState {
+		e = toolOutbox.Add(ctx, t, "用户状态", &user.Info{Username: in.GetUsername(), State: in.GetState()})
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+	}
+
+	// 停用或删除后凭证失效, 修改角色时更新凭证的角色
+	if in.GetState() != "正常" {
+		toolCache.DelUserToken(in.GetUsername())
+	} else if in.GetRole() != "" {
+		toolCache.SetUserRole(in.GetUsername(), in.GetRole())
 	}
 
 	return &user.Empty{}, nil
@@ -94,7 +281,7 @@ func (s *server) Search(ctx context.Context, in *user.SearchRequest) (*user.Sear
 	}
 	sqlWhere := `1 = 1`
 	if in.Keyword != "" {
-		sqlWhere = fmt.Sprintf(`%s and concat(j->>'username') like '%s'`,
+		sqlWhere = fmt.Sprintf(`%s and concat(j->>'username', j->>'display_name', j->>'email', j->>'mobile_phone', j->>'card_number') like '%s'`,
 			sqlWhere,
 			fmt.Sprint(`%`, in.Keyword, `%`),
 		)
@@ -143,6 +330,85 @@ func (s *server) Search(ctx context.Context, in *user.SearchRequest) (*user.Sear
 	return &result, nil
 }
 
+// 按用户名查询, 返回用户名和信息的映射
+func getUserMap(ctx context.Context, usernameArray []string) (map[string]*user.Info, error) {
+	sqlIn := make([]string, len(usernameArray))
+	for i, v := range usernameArray {
+		sqlIn[i] = fmt.Sprintf(`'%s'`, v)
+	}
+	rows, e := sdb.Query(ctx, fmt.Sprintf(`select j from %s where j->>'username' in (%s)`, toolSql.TableNameUser, strings.Join(sqlIn, ",")))
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	infoMap := make(map[string]*user.Info)
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, e
+		}
+		var info user.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, e
+		}
+		infoMap[info.GetUsername()] = &info
+	}
+	return infoMap, rows.Err()
+}
+
+func (s *server) Get(ctx context.Context, in *user.GetRequest) (*user.Info, error) {
+	if in.GetUsername() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要用户名")
+	}
+
+	infoMap, e := getUserMap(ctx, []string{in.GetUsername()})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	info, exists := infoMap[in.GetUsername()]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "用户名不存在")
+	}
+
+	return info, nil
+}
+
+func (s *server) BatchGet(ctx context.Context, in *user.BatchGetRequest) (*user.BatchGetResponse, error) {
+	if len(in.GetUsernames()) == 0 || len(in.GetUsernames()) > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "用户名数量必须在1到100以内")
+	}
+	for _, v := range in.GetUsernames() {
+		if v == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "需要用户名")
+		}
+	}
+
+	infoMap, e := getUserMap(ctx, in.GetUsernames())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 按请求顺序返回
+	var infoArray []*user.Info
+	var notFoundArray []string
+	for _, v := range in.GetUsernames() {
+		info, exists := infoMap[v]
+		if !exists {
+			notFoundArray = append(notFoundArray, v)
+			continue
+		}
+		infoArray = append(infoArray, info)
+	}
+	if len(notFoundArray) > 0 {
+		return nil, status.Errorf(codes.NotFound, "用户名不存在:%s", strings.Join(notFoundArray, ","))
+	}
+
+	return &user.BatchGetResponse{InfoArray: infoArray}, nil
+}
+
 func (s *server) Auth(ctx context.Context, in *user.AuthRequest) (*user.AuthResponse, error) {
 	// 检查
 	if in.GetUsername() == "" {
@@ -157,10 +423,21 @@ func (s *server) Auth(ctx context.Context, in *user.AuthRequest) (*user.AuthResp
 	} else if e != nil {
 		return nil, status.Errorf(codes.Internal, e.Error())
 	}
+	var info user.Info
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if info.GetState() == "待验证" {
+		return nil, status.Errorf(codes.PermissionDenied, "用户电子邮箱待验证")
+	}
+	if info.GetState() != "正常" {
+		return nil, status.Errorf(codes.PermissionDenied, "用户已%s", info.GetState())
+	}
 
 	// 更新凭证
 	newToken := uuid.New().String()
-	toolCache.SetUserToken(in.GetUsername(), newToken)
+	toolCache.SetUserToken(in.GetUsername(), newToken, toolRole.Name(info.GetRole()))
 
 	// TODO 发出推送
 
@@ -178,3 +455,55 @@ func (s *server) Exit(ctx context.Context, in *user.Empty) (*user.Empty, error)
 
 	return &user.Empty{}, nil
 }
+
+func (s *server) Me(ctx context.Context, in *user.Empty) (*user.MeResponse, error) {
+	// 获取上下文
+	userId := ctx.Value(toolApi.ContextKeyUserId).(string)
+	userToken := ctx.Value(toolApi.ContextKeyUserToken).(string)
+	clientIp := ctx.Value(toolApi.ContextKeyClientIp).(string)
+
+	// 用户资料
+	infoMap, e := getUserMap(ctx, []string{userId})
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	info, exists := infoMap[userId]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "用户名不存在:%s", userId)
+	}
+	info.Role = toolRole.Name(info.GetRole())
+
+	// 会员等级
+	tierInfo, e := toolTier.UserTier(ctx, sdb, userId)
+	if e != nil && e != pgx.ErrNoRows {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	loanSummary := user.LoanSummary{}
+	if tierInfo != nil {
+		loanSummary.TierCode = tierInfo.GetCode()
+		loanSummary.MaxLoanCount = tierInfo.GetMaxLoanCount()
+		loanSummary.MaxTitleCount = tierInfo.GetMaxTitleCount()
+		loanSummary.LoanDays = tierInfo.GetLoanDays()
+	}
+
+	// 在借汇总
+	e = sdb.QueryRow(ctx, fmt.Sprintf(`select coalesce(sum(cast(b->>'count' as integer)), 0), count(distinct b->>'code') from %s, jsonb_array_elements(j->'books') as b where j->>'username' = '%s'`, toolSql.TableNameUserBorrow, userId)).Scan(&loanSummary.LoanCount, &loanSummary.TitleCount)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	// 会话信息
+	session := user.SessionInfo{Token: userToken, ClientIp: clientIp}
+	loginTime := toolCache.GetTokenTime(userToken)
+	if !loginTime.IsZero() {
+		session.LoginTimeText = loginTime.Format(timeLayout)
+	}
+
+	return &user.MeResponse{
+		Info:        info,
+		Roles:       []string{info.GetRole()},
+		Permissions: toolRole.Methods(info.GetRole()),
+		Session:     &session,
+		LoanSummary: &loanSummary,
+	}, nil
+}
@@ -88,12 +88,84 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestProfile(t *testing.T) {
+	// 电子邮箱无效
+	_, e := gc.Add(mc, &user.Info{
+		Username: fmt.Sprint("测试资料-", uuid.New().String()),
+		State:    "正常",
+		Email:    "无效",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("电子邮箱无效", gs.Code(), gs.Message())
+	}
+
+	// 手机号码无效
+	_, e = gc.Add(mc, &user.Info{
+		Username:    fmt.Sprint("测试资料-", uuid.New().String()),
+		State:       "正常",
+		MobilePhone: "123",
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("手机号码无效", gs.Code(), gs.Message())
+	}
+
+	// 正常添加
+	id := uuid.New().String()
+	email := fmt.Sprint(id, "@test.cn")
+	_, e = gc.Add(mc, &user.Info{
+		Username:    fmt.Sprint("测试资料-", id),
+		State:       "正常",
+		DisplayName: "测试资料",
+		Email:       email,
+		MobilePhone: "13800000000",
+		CardNumber:  id,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 电子邮箱重复
+	_, e = gc.Add(mc, &user.Info{
+		Username: fmt.Sprint("测试资料-", uuid.New().String()),
+		State:    "正常",
+		Email:    email,
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("电子邮箱重复", gs.Code(), gs.Message())
+	}
+
+	// 按借书证号查询
+	result, e := gc.Search(mc, &user.SearchRequest{
+		PageStart: 1,
+		PageCount: 10,
+		Keyword:   id,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetCount() != 1 {
+		t.Fatal("按借书证号查询", result.GetCount())
+	}
+}
+
 func TestChange(t *testing.T) {
 	// 用户名无效
-	_, e := gc.Change(mc, &user.Info{
+	_, e := gc.Change(mc, &user.ChangeRequest{Info: &user.Info{
 		Username: "不存在",
 		State:    "删除",
-	})
+	}})
 	gs, gsOk := status.FromError(e)
 	if !gsOk {
 		t.Fatal(e)
@@ -118,10 +190,10 @@ func TestChange(t *testing.T) {
 	}
 
 	// 正常修改
-	_, e = gc.Change(mc, &user.Info{
+	_, e = gc.Change(mc, &user.ChangeRequest{Info: &user.Info{
 		Username: username,
 		State:    "删除",
-	})
+	}})
 	gs, gsOk = status.FromError(e)
 	if !gsOk {
 		t.Fatal(e)
@@ -188,6 +260,91 @@ func TestSearch(t *testing.T) {
 	t.Log("正常状态数量", result.GetCount())
 }
 
+func TestGet(t *testing.T) {
+	// 不存在
+	_, e := gc.Get(mc, &user.GetRequest{Username: fmt.Sprint("不存在-", uuid.New().String())})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("不存在", gs.Code(), gs.Message())
+	}
+
+	// 正常获取
+	result, e := gc.Get(mc, &user.GetRequest{Username: "测试"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestBatchGet(t *testing.T) {
+	username := fmt.Sprint("测试批量获取-", uuid.New().String())
+
+	// 添加用户
+	_, e := gc.Add(mc, &user.Info{
+		Username: username,
+		State:    "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 按请求顺序返回
+	result, e := gc.BatchGet(mc, &user.BatchGetRequest{Usernames: []string{username, "测试"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(result.GetInfoArray()) != 2 || result.GetInfoArray()[0].GetUsername() != username {
+		t.Fatal("请求顺序", result)
+	}
+
+	// 任一不存在
+	_, e = gc.BatchGet(mc, &user.BatchGetRequest{Usernames: []string{"测试", fmt.Sprint("不存在-", uuid.New().String())}})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.NotFound {
+		t.Fatal("任一不存在", gs.Code(), gs.Message())
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	username := fmt.Sprint("测试停用-", uuid.New().String())
+
+	// 添加用户
+	_, e := gc.Add(mc, &user.Info{
+		Username: username,
+		State:    "正常",
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 停用
+	_, e = gc.Change(mc, &user.ChangeRequest{Info: &user.Info{
+		Username: username,
+		State:    "停用",
+	}})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 停用的用户不能登录
+	_, e = gc.Auth(mc, &user.AuthRequest{
+		Username: username,
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.PermissionDenied {
+		t.Fatal("停用的用户不能登录", gs.Code(), gs.Message())
+	}
+}
+
 func TestAuth(t *testing.T) {
 	username := fmt.Sprint("测试登录-", uuid.New().String())
 
@@ -219,6 +376,93 @@ func TestAuth(t *testing.T) {
 	t.Log("获得凭证", token)
 }
 
+func TestRegister(t *testing.T) {
+	username := fmt.Sprint("测试注册-", uuid.New().String())
+
+	// 电子邮箱无效
+	_, e := gc.Register(context.Background(), &user.RegisterRequest{
+		Username: username,
+		Email:    "abc",
+	})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("电子邮箱无效", gs.Code(), gs.Message())
+	}
+
+	// 注册(公开接口, 无需凭证)
+	_, e = gc.Register(context.Background(), &user.RegisterRequest{
+		Username: username,
+		Email:    fmt.Sprint(uuid.New().String(), "@example.com"),
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 待验证的用户不能登录
+	_, e = gc.Auth(mc, &user.AuthRequest{
+		Username: username,
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.PermissionDenied {
+		t.Fatal("待验证的用户不能登录", gs.Code(), gs.Message())
+	}
+
+	// 验证码错误
+	_, e = gc.VerifyEmail(context.Background(), &user.VerifyEmailRequest{
+		Username: username,
+		Code:     "abcdef",
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("验证码错误", gs.Code(), gs.Message())
+	}
+
+	// 重发过于频繁
+	_, e = gc.ResendVerifyCode(context.Background(), &user.ResendVerifyCodeRequest{
+		Username: username,
+	})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.ResourceExhausted {
+		t.Fatal("重发过于频繁", gs.Code(), gs.Message())
+	}
+}
+
+func TestMe(t *testing.T) {
+	result, e := gc.Me(mc, &user.Empty{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if result.GetInfo().GetUsername() != "测试" {
+		t.Fatal("当前用户", result.GetInfo().GetUsername())
+	}
+	if len(result.GetRoles()) == 0 || result.GetRoles()[0] != "馆员" {
+		t.Fatal("角色", result.GetRoles())
+	}
+	t.Log(result)
+
+	// 没有凭证
+	_, e = gc.Me(context.Background(), &user.Empty{})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.PermissionDenied {
+		t.Fatal("没有凭证", gs.Code(), gs.Message())
+	}
+}
+
 // // 不执行, 以免在批量测试时影响其它测试.
 // func TestExit(t *testing.T) {
 // 	_, e := gc.Exit(mc, &user.Empty{})
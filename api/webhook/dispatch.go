@@ -0,0 +1,309 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gs/filelog"
+	"gs/proto/webhook"
+	toolApi "gs/tool/api"
+	"gs/tool/env"
+	toolSql "gs/tool/sql"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/robfig/cron/v3"
+)
+
+// 每次分发和发送的最多数量
+const batchCount = 100
+
+var client = http.Client{Timeout: time.Second * 10}
+
+// Init 按事件发送间隔安排分发和发送, 在 main.go 中调用一次
+func Init() {
+	cs := cron.New(cron.WithSeconds(), cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	_, e := cs.AddFunc(fmt.Sprintf("@every %ss", env.WebhookIntervalSeconds), func() {
+		e := Dispatch(context.Background())
+		if e != nil {
+			filelog.Warn("发送事件失败", e.Error())
+		}
+	})
+	if e != nil {
+		filelog.Warn("安排事件发送失败", e.Error())
+		return
+	}
+	cs.Start()
+}
+
+// Sign 签名, 请求头 X-Bs-Signature 的值
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 重试间隔: 10秒起每次加倍, 最多1小时
+func backoff(attemptCount int32) time.Duration {
+	d := time.Second * 10
+	for i := int32(1); i < attemptCount && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// Dispatch 分发待分发的事件, 并发送到期的事件
+//
+// 使用 FOR UPDATE SKIP LOCKED 领取, 多个实例同时运行时不会重复发送
+func Dispatch(ctx context.Context) error {
+	e := fanOut(ctx)
+	if e != nil {
+		return e
+	}
+	for i := 0; i < batchCount; i++ {
+		ok, e := deliverOne(ctx)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			break
+		}
+	}
+	return nil
+}
+
+// 为待分发的事件按事件类型创建发送
+func fanOut(ctx context.Context) error {
+	db := toolSql.GetDb()
+
+	// 准备事务
+	t, e := db.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	rows, e := t.Query(ctx, fmt.Sprintf(`select j->>'id', j->>'type' from %s where j->>'state' = '待分发' order by j->>'date_text' limit %d FOR UPDATE SKIP LOCKED;`, toolSql.TableNameOutbox, batchCount))
+	if e != nil {
+		return e
+	}
+	var events [][2]string
+	for rows.Next() {
+		var id, eventType string
+		e = rows.Scan(&id, &eventType)
+		if e != nil {
+			rows.Close()
+			return e
+		}
+		events = append(events, [2]string{id, eventType})
+	}
+	rows.Close()
+
+	now := time.Now().Format("2006-01-02T15:04:05")
+	for _, event := range events {
+		// 正常状态且订阅该事件类型(没有指定时为全部)的事件通知
+		var webhookIds []string
+		rows, e = t.Query(ctx, fmt.Sprintf(`select j->>'id' from %s where j->>'state' = '正常' and (jsonb_array_length(coalesce(j->'event_types', '[]')) = 0 or j->'event_types' ? '%s');`, toolSql.TableNameWebhook, event[1]))
+		if e != nil {
+			return e
+		}
+		for rows.Next() {
+			var webhookId string
+			e = rows.Scan(&webhookId)
+			if e != nil {
+				rows.Close()
+				return e
+			}
+			webhookIds = append(webhookIds, webhookId)
+		}
+		rows.Close()
+
+		for _, webhookId := range webhookIds {
+			delivery := webhook.DeliveryInfo{
+				Id:           uuid.New().String(),
+				DateText:     now,
+				WebhookId:    webhookId,
+				EventId:      event[0],
+				EventType:    event[1],
+				State:        "待发送",
+				NextDateText: now,
+			}
+			deliveryText, _ := toolApi.ProtoToJson(&delivery)
+			_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameWebhookDelivery, deliveryText))
+			if e != nil {
+				return e
+			}
+		}
+		_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"state": "已分发"}' where j->>'id' = '%s';`, toolSql.TableNameOutbox, event[0]))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// 发送一个到期的事件, 没有时返回 false
+//
+// 领取和更新结果分别在短事务中, 发送时不持有事务和行锁.
+// 领取时置为发送中并设置租约, 实例在发送中退出时租约到期后重新领取.
+func deliverOne(ctx context.Context) (bool, error) {
+	delivery, hook, event, e := claimDelivery(ctx)
+	if e != nil || delivery == nil || hook == nil {
+		return delivery != nil, e
+	}
+	lease := delivery.GetNextDateText()
+	sendError := send(hook, event, delivery.GetId())
+
+	// 更新发送状态, 租约到期被重新领取时不更新
+	now := time.Now()
+	maxAttempts, _ := strconv.Atoi(env.WebhookMaxAttempts)
+	if sendError == nil {
+		delivery.State = "已发送"
+		delivery.LastError = ""
+		delivery.DeliveredDateText = now.Format("2006-01-02T15:04:05")
+	} else {
+		delivery.LastError = sendError.Error()
+		if int(delivery.GetAttemptCount()) >= maxAttempts {
+			delivery.State = "死信"
+		} else {
+			delivery.State = "待发送"
+			delivery.NextDateText = now.Add(backoff(delivery.GetAttemptCount())).Format("2006-01-02T15:04:05")
+		}
+	}
+	deliveryText, _ := toolApi.ProtoToJson(delivery)
+	_, e = toolSql.GetDb().Exec(ctx, fmt.Sprintf(`update %s set j = '%s' where j->>'id' = '%s' and j->>'state' = '发送中' and j->>'next_date_text' = '%s';`, toolSql.TableNameWebhookDelivery, deliveryText, delivery.GetId(), lease))
+	if e != nil {
+		return false, e
+	}
+	return true, nil
+}
+
+// 领取一个到期的发送, 没有时返回空
+//
+// 事件通知已停用时置为已跳过, 返回的事件通知为空
+func claimDelivery(ctx context.Context) (*webhook.DeliveryInfo, *webhook.Info, *webhook.EventInfo, error) {
+	db := toolSql.GetDb()
+
+	// 准备事务
+	t, e := db.BeginTx(ctx, pgx.TxOptions{})
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	defer func() {
+		if e != nil {
+			filelog.Debug("回滚事务", e.Error())
+			t.Rollback(ctx)
+		} else {
+			filelog.Debug("提交事务")
+			t.Commit(ctx)
+		}
+	}()
+
+	// 领取待发送和租约到期的发送中
+	now := time.Now()
+	var deliveryText string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j from %s where j->>'state' in ('待发送', '发送中') and j->>'next_date_text' <= '%s' order by j->>'next_date_text' limit 1 FOR UPDATE SKIP LOCKED;`,
+		toolSql.TableNameWebhookDelivery, now.Format("2006-01-02T15:04:05"))).Scan(&deliveryText)
+	if e == pgx.ErrNoRows {
+		e = nil
+		return nil, nil, nil, nil
+	} else if e != nil {
+		return nil, nil, nil, e
+	}
+	var delivery webhook.DeliveryInfo
+	e = toolApi.JsonToProto(deliveryText, &delivery)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+
+	var hookText, eventText string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select h.j, o.j from %s as h, %s as o where h.j->>'id' = '%s' and o.j->>'id' = '%s'`,
+		toolSql.TableNameWebhook, toolSql.TableNameOutbox, delivery.GetWebhookId(), delivery.GetEventId())).Scan(&hookText, &eventText)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	var hook webhook.Info
+	var event webhook.EventInfo
+	e = toolApi.JsonToProto(hookText, &hook)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	e = toolApi.JsonToProto(eventText, &event)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+
+	// 已停用的不再发送
+	if hook.GetState() != "正常" {
+		delivery.State = "已跳过"
+		delivery.LastError = "事件通知已停用"
+		deliveryText, _ = toolApi.ProtoToJson(&delivery)
+		_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = '%s' where j->>'id' = '%s';`, toolSql.TableNameWebhookDelivery, deliveryText, delivery.GetId()))
+		if e != nil {
+			return nil, nil, nil, e
+		}
+		return &delivery, nil, nil, nil
+	}
+
+	// 置为发送中, 租约为请求超时的两倍
+	delivery.State = "发送中"
+	delivery.AttemptCount++
+	delivery.NextDateText = now.Add(client.Timeout * 2).Format("2006-01-02T15:04:05")
+	deliveryText, _ = toolApi.ProtoToJson(&delivery)
+	_, e = t.Exec(ctx, fmt.Sprintf(`update %s set j = '%s' where j->>'id' = '%s';`, toolSql.TableNameWebhookDelivery, deliveryText, delivery.GetId()))
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	return &delivery, &hook, &event, nil
+}
+
+// 发送事件, 返回非 2xx 时为错误
+func send(hook *webhook.Info, event *webhook.EventInfo, deliveryId string) error {
+	body, e := json.Marshal(map[string]any{
+		"id":        event.GetId(),
+		"date_text": event.GetDateText(),
+		"type":      event.GetType(),
+		"payload":   json.RawMessage(event.GetPayload()),
+	})
+	if e != nil {
+		return e
+	}
+	request, e := http.NewRequest(http.MethodPost, hook.GetUrl(), bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Bs-Event", event.GetType())
+	request.Header.Set("X-Bs-Delivery", deliveryId)
+	request.Header.Set("X-Bs-Signature", Sign(hook.GetSecret(), body))
+
+	response, e := client.Do(request)
+	if e != nil {
+		return e
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("返回状态:%d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/webhook"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	toolRole "gs/tool/role"
+	toolSql "gs/tool/sql"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 实现服务
+type server struct {
+	webhook.UnimplementedWebhookServer
+}
+
+var sdb *pgxpool.Pool
+
+// 事件类型
+var eventTypes = []string{"借出", "归还", "遗失", "损坏", "图书增加", "图书修改", "用户状态"}
+
+func checkInfoRequest(in *webhook.Info) error {
+	u, e := url.Parse(in.GetUrl())
+	if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return status.Errorf(codes.InvalidArgument, "地址无效")
+	}
+	if in.GetSecret() != "" && len(in.GetSecret()) < 16 {
+		return status.Errorf(codes.InvalidArgument, "密钥至少16个字符")
+	}
+	for _, v := range in.GetEventTypes() {
+		if tool.ArrayIndex(v, eventTypes) == -1 {
+			return status.Errorf(codes.InvalidArgument, "事件类型无效:%s", v)
+		}
+	}
+	if tool.ArrayIndex(in.GetState(), []string{"正常", "停用"}) == -1 {
+		return status.Errorf(codes.InvalidArgument, "状态无效")
+	}
+
+	return nil
+}
+
+// Register 注册服务, 传递公共资源
+func Register(s grpc.ServiceRegistrar) {
+	webhook.RegisterWebhookServer(s, &server{})
+
+	sdb = toolSql.GetDb()
+}
+
+func (s *server) Add(ctx context.Context, in *webhook.Info) (*webhook.Info, error) {
+	// 基本校验, 推送全部事件并由服务访问地址, 仅馆员可以设置
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+		return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以设置推送")
+	}
+	in.State = "正常"
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+	if in.GetSecret() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要密钥")
+	}
+
+	// 保存入库
+	in.Id = uuid.New().String()
+	in.DateText = time.Now().Format("2006-01-02T15:04:05")
+	inText, _ := toolApi.ProtoToJson(in)
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`insert into %s values($1);`, toolSql.TableNameWebhook), inText)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "保存失败")
+	}
+
+	return &webhook.Info{Id: in.GetId(), Url: in.GetUrl(), EventTypes: in.GetEventTypes(), State: in.GetState(), DateText: in.GetDateText()}, nil
+}
+
+func (s *server) Change(ctx context.Context, in *webhook.Info) (*webhook.Empty, error) {
+	// 基本校验
+	if ctx.Value(toolApi.ContextKeyUserRole).(string) != toolRole.Librarian {
+		return nil, status.Errorf(codes.PermissionDenied, "只有馆员可以设置推送")
+	}
+	if in.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要id")
+	}
+	e := checkInfoRequest(in)
+	if e != nil {
+		return nil, e
+	}
+
+	// 保存入库, 值都使用参数传递, 密钥为空时不修改
+	eventTypesText, _ := toolApi.ProtoToJson(&webhook.Info{EventTypes: in.GetEventTypes()})
+	ct, e := sdb.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('url', $1::text, 'state', $2::text, 'event_types', cast($3::text as jsonb)->'event_types')
+|| case when $4::text = '' then '{}'::jsonb else jsonb_build_object('secret', $4::text) end where j->>'id' = $5;`, toolSql.TableNameWebhook),
+		in.GetUrl(), in.GetState(), eventTypesText, in.GetSecret(), in.GetId())
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "id无效")
+	}
+
+	return &webhook.Empty{}, nil
+}
+
+func (s *server) Search(ctx context.Context, in *webhook.SearchRequest) (*webhook.SearchResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameWebhook, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j - 'secret' from %s where %s order by j->>'date_text' offset %v limit %v`, toolSql.TableNameWebhook, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var infoArray []*webhook.Info
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info webhook.Info
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := webhook.SearchResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
+
+func (s *server) SearchDelivery(ctx context.Context, in *webhook.SearchDeliveryRequest) (*webhook.SearchDeliveryResponse, error) {
+	// 检查数据
+	if in.GetPageStart() < 1 || in.GetPageCount() < 1 || in.GetPageCount() > 100 {
+		return nil, status.Errorf(codes.InvalidArgument, "该页开始行数必须大于1, 该页数量必须在1到100以内")
+	}
+	sqlWhere := `1 = 1`
+	if in.GetWebhookId() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'webhook_id' = '%s'`, sqlWhere, in.GetWebhookId())
+	}
+	if in.GetEventId() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'event_id' = '%s'`, sqlWhere, in.GetEventId())
+	}
+	if in.GetState() != "" {
+		sqlWhere = fmt.Sprintf(`%s and j->>'state' = '%s'`, sqlWhere, in.GetState())
+	}
+
+	sqlCount := fmt.Sprintf(`select count(*) from %s where %s`, toolSql.TableNameWebhookDelivery, sqlWhere)
+	sqlFull := fmt.Sprintf(`select j from %s where %s order by j->>'date_text' desc offset %v limit %v`, toolSql.TableNameWebhookDelivery, sqlWhere, in.PageStart-1, in.PageCount)
+
+	var count int32
+	e := sdb.QueryRow(ctx, sqlCount).Scan(&count)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	rows, e := sdb.Query(ctx, sqlFull)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	defer rows.Close()
+	var infoArray []*webhook.DeliveryInfo
+	for rows.Next() {
+		var jsonText string
+		e = rows.Scan(&jsonText)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		var info webhook.DeliveryInfo
+		e = toolApi.JsonToProto(jsonText, &info)
+		if e != nil {
+			return nil, status.Errorf(codes.Internal, e.Error())
+		}
+		infoArray = append(infoArray, &info)
+	}
+	result := webhook.SearchDeliveryResponse{Count: count, InfoArray: infoArray}
+	return &result, nil
+}
+
+func (s *server) Redeliver(ctx context.Context, in *webhook.RedeliverRequest) (*webhook.DeliveryInfo, error) {
+	if in.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "需要发送id")
+	}
+
+	var jsonText string
+	e := sdb.QueryRow(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('state', '待发送', 'attempt_count', 0, 'next_date_text', '%s') where j->>'id' = '%s' and j->>'state' = '死信' returning j;`,
+		toolSql.TableNameWebhookDelivery, time.Now().Format("2006-01-02T15:04:05"), in.GetId())).Scan(&jsonText)
+	if e == pgx.ErrNoRows {
+		return nil, status.Errorf(codes.FailedPrecondition, "发送id无效或不是死信")
+	} else if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+
+	var info webhook.DeliveryInfo
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, e.Error())
+	}
+	return &info, nil
+}
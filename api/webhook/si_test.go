@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"gs/proto/book"
+	"gs/proto/webhook"
+	toolApi "gs/tool/api"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var mc context.Context
+var gc webhook.WebhookClient
+var bc book.BookClient
+
+func TestMain(m *testing.M) {
+	// 创建连接
+	ctxTimeOut, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+	conn, e := toolApi.GetGrpcConn(ctxTimeOut)
+	if e != nil {
+		log.Fatal(e)
+	}
+	defer conn.Close()
+
+	// 获取Metadata上下文
+	mc = toolApi.GetGrpcMetadata(ctxTimeOut)
+
+	// 创建客户端
+	gc = webhook.NewWebhookClient(conn)
+	bc = book.NewBookClient(conn)
+
+	m.Run()
+}
+
+func TestAdd(t *testing.T) {
+	// 密钥过短
+	_, e := gc.Add(mc, &webhook.Info{Url: "http://localhost/hook", Secret: "short"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("密钥过短", gs.Code(), gs.Message())
+	}
+
+	// 事件类型无效
+	_, e = gc.Add(mc, &webhook.Info{Url: "http://localhost/hook", Secret: "0123456789abcdef", EventTypes: []string{"无效"}})
+	gs, gsOk = status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.InvalidArgument {
+		t.Fatal("事件类型无效", gs.Code(), gs.Message())
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	// 本地接收事件
+	secret := "0123456789abcdef"
+	type received struct {
+		signature string
+		body      []byte
+	}
+	receivedChan := make(chan received, 10)
+	stand := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedChan <- received{signature: r.Header.Get("X-Bs-Signature"), body: body}
+	}))
+	defer stand.Close()
+
+	info, e := gc.Add(mc, &webhook.Info{Url: stand.URL, Secret: secret, EventTypes: []string{"图书修改"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer gc.Change(mc, &webhook.Info{Id: info.GetId(), Url: stand.URL, EventTypes: []string{"图书修改"}, State: "停用"})
+
+	// 修改图书产生事件
+	bookInfo, e := bc.Get(mc, &book.GetRequest{Code: "SN1"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, e = bc.Change(mc, &book.Info{Code: bookInfo.GetCode(), Name: bookInfo.GetName(), TotalCount: bookInfo.GetTotalCount(), State: bookInfo.GetState()})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	select {
+	case v := <-receivedChan:
+		if v.signature != Sign(secret, v.body) {
+			t.Fatal("签名", v.signature)
+		}
+		var event struct {
+			Type    string    `json:"type"`
+			Payload book.Info `json:"payload"`
+		}
+		e = json.Unmarshal(v.body, &event)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if event.Type != "图书修改" {
+			t.Fatal("事件类型", event.Type)
+		}
+		t.Log(string(v.body))
+	case <-time.After(time.Second * 30):
+		t.Fatal("没有收到事件")
+	}
+
+	result, e := gc.SearchDelivery(mc, &webhook.SearchDeliveryRequest{PageStart: 1, PageCount: 10, WebhookId: info.GetId()})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+}
+
+func TestDeadLetter(t *testing.T) {
+	// 死信列表
+	result, e := gc.SearchDelivery(mc, &webhook.SearchDeliveryRequest{PageStart: 1, PageCount: 10, State: "死信"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(result)
+
+	// 不是死信不能重新发送
+	_, e = gc.Redeliver(mc, &webhook.RedeliverRequest{Id: "不存在"})
+	gs, gsOk := status.FromError(e)
+	if !gsOk {
+		t.Fatal(e)
+	}
+	if gs.Code() != codes.FailedPrecondition {
+		t.Fatal("不是死信", gs.Code(), gs.Message())
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"gs/api"
+	apiBorrow "gs/api/borrow"
+	"gs/api/remind"
+	"gs/api/webhook"
 	"gs/filelog"
 	toolEnv "gs/tool/env"
 	toolSql "gs/tool/sql"
@@ -11,6 +17,27 @@ import (
 	"syscall"
 )
 
+// 命令行对账: gs reconcile [-repair], 有不一致且没有修复时退出码为 2
+func reconcile(args []string) int {
+	flagSet := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := flagSet.Bool("repair", false, "修复不一致")
+	flagSet.Parse(args)
+
+	result, e := apiBorrow.Reconcile(context.Background(), *repair)
+	if e != nil {
+		filelog.Error("对账失败", e.Error())
+		return 1
+	}
+	for _, info := range result.GetInfoArray() {
+		fmt.Printf("%s\t%s\t%s\t%s\t应为%d\t实际%d\n", info.GetType(), info.GetUsername(), info.GetCode(), info.GetLocationCode(), info.GetExpectedCount(), info.GetActualCount())
+	}
+	fmt.Printf("不一致:%d 已修复:%v\n", len(result.GetInfoArray()), result.GetRepaired())
+	if len(result.GetInfoArray()) > 0 && !result.GetRepaired() {
+		return 2
+	}
+	return 0
+}
+
 func main() {
 	// 检查环境变量
 	e := toolEnv.Error()
@@ -28,6 +55,19 @@ func main() {
 	// 创建postgres连接池
 	toolSql.Init()
 
+	// 命令行模式
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		code := reconcile(os.Args[2:])
+		filelog.Over()
+		os.Exit(code)
+	}
+
+	// 安排到期提醒
+	remind.Init()
+
+	// 安排事件发送
+	webhook.Init()
+
 	// 启动gRPC
 	go func() {
 		api.Init()
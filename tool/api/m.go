@@ -25,6 +25,9 @@ const (
 
 	// 用户ID
 	ContextKeyUserId contextKey = "user-id"
+
+	// 用户角色
+	ContextKeyUserRole contextKey = "user-role"
 )
 
 var (
@@ -1,30 +1,90 @@
 package cache
 
+import (
+	"sync"
+	"time"
+)
+
+var lock sync.RWMutex
 var userTokenMap = make(map[string]string)
 var tokenUserMap = make(map[string]string)
+var tokenTimeMap = make(map[string]time.Time)
+var tokenRoleMap = make(map[string]string)
 
 func init() {
 	// TODO 仅供演示
 	userTokenMap["测试"] = "d6449e41-e039-4458-8ab4-b47516aeacb1"
 	tokenUserMap["d6449e41-e039-4458-8ab4-b47516aeacb1"] = "测试"
+	tokenTimeMap["d6449e41-e039-4458-8ab4-b47516aeacb1"] = time.Now()
+	tokenRoleMap["d6449e41-e039-4458-8ab4-b47516aeacb1"] = "馆员"
 }
 
-func SetUserToken(user_id, token string) {
+// SetUserToken 设置凭证, 同时记录登录时的角色
+func SetUserToken(user_id, token, role string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// 旧凭证失效
+	if oldToken, exists := userTokenMap[user_id]; exists {
+		delete(tokenUserMap, oldToken)
+		delete(tokenTimeMap, oldToken)
+		delete(tokenRoleMap, oldToken)
+	}
+
 	userTokenMap[user_id] = token
 	tokenUserMap[token] = user_id
+	tokenTimeMap[token] = time.Now()
+	tokenRoleMap[token] = role
+}
+
+// SetUserRole 修改已登录用户的角色, 没有登录时忽略
+func SetUserRole(user_id, role string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if token, exists := userTokenMap[user_id]; exists {
+		tokenRoleMap[token] = role
+	}
 }
 
 func GetUserToken(user_id string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	return userTokenMap[user_id]
 }
 
 func GetTokenUser(token string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	return tokenUserMap[token]
 }
 
+// GetTokenTime 凭证创建时间, 凭证无效时为零值
+func GetTokenTime(token string) time.Time {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return tokenTimeMap[token]
+}
+
+// GetTokenRole 凭证所属用户的角色, 凭证无效时为空
+func GetTokenRole(token string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return tokenRoleMap[token]
+}
+
 func DelUserToken(user_id string) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	if token, exists := userTokenMap[user_id]; exists {
 		delete(tokenUserMap, token)
+		delete(tokenTimeMap, token)
+		delete(tokenRoleMap, token)
 	}
 
 	delete(userTokenMap, user_id)
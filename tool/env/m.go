@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+
+	"github.com/robfig/cron/v3"
 )
 
 var (
@@ -20,8 +22,55 @@ var (
 	TlsCrtPath = os.Getenv("TLS_CRT_PATH")
 	// [可选]TLS密钥路径
 	TlsKeyPath = os.Getenv("TLS_KEY_PATH")
+
+	// [可选]图书封面目录, 默认为 cover
+	CoverPath = getOrDefault("BS_SERVICE_COVER_PATH", "cover")
+
+	// [可选]预约保留天数, 默认为 3, 超过时预约过期
+	HoldPickupDays = getOrDefault("BS_SERVICE_HOLD_PICKUP_DAYS", "3")
+
+	// [可选]幂等键保留小时数, 默认为 24
+	IdempotencyHours = getOrDefault("BS_SERVICE_IDEMPOTENCY_HOURS", "24")
+
+	// [可选]邮件发送: [smtp,file], 默认为 file
+	MailSender = getOrDefault("BS_SERVICE_MAIL_SENDER", "file")
+	// [可选]邮件文件路径, 邮件发送为 file 时使用, 为空时写入标准输出
+	MailFilePath = os.Getenv("BS_SERVICE_MAIL_FILE_PATH")
+	// [可选]SMTP地址, 例如 smtp.example.com:587
+	SmtpAddr = os.Getenv("BS_SERVICE_SMTP_ADDR")
+	// [可选]SMTP用户名
+	SmtpUsername = os.Getenv("BS_SERVICE_SMTP_USERNAME")
+	// [可选]SMTP密码
+	SmtpPassword = os.Getenv("BS_SERVICE_SMTP_PASSWORD")
+	// [可选]SMTP发件人
+	SmtpFrom = os.Getenv("BS_SERVICE_SMTP_FROM")
+
+	// [可选]提醒定时(cron表达式, 含秒), 默认为 0 0 9 * * * (每天9点)
+	RemindSchedule = getOrDefault("BS_SERVICE_REMIND_SCHEDULE", "0 0 9 * * *")
+	// [可选]到期前提醒天数, 默认为 2
+	RemindDueDays = getOrDefault("BS_SERVICE_REMIND_DUE_DAYS", "2")
+	// [可选]提醒通知: [email,sms,file], 默认为 file
+	Notifier = getOrDefault("BS_SERVICE_NOTIFIER", "file")
+	// [可选]提醒文件路径, 提醒通知为 file 时使用, 为空时写入标准输出
+	NotifyFilePath = os.Getenv("BS_SERVICE_NOTIFY_FILE_PATH")
+	// [可选]短信网关地址, 提醒通知为 sms 时使用, 以JSON {"mobile_phone","text"} POST
+	SmsGatewayUrl = os.Getenv("BS_SERVICE_SMS_GATEWAY_URL")
+
+	// [可选]事件发送间隔秒数, 默认为 5
+	WebhookIntervalSeconds = getOrDefault("BS_SERVICE_WEBHOOK_INTERVAL_SECONDS", "5")
+	// [可选]事件发送最多尝试次数, 默认为 8, 超过时为死信
+	WebhookMaxAttempts = getOrDefault("BS_SERVICE_WEBHOOK_MAX_ATTEMPTS", "8")
 )
 
+// 获取环境变量, 没有设置时使用默认值
+func getOrDefault(key, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
 // 获取错误
 func Error() error {
 	if SystemId == "" {
@@ -40,5 +89,46 @@ func Error() error {
 		return fmt.Errorf("没有设置:postgres连接")
 	}
 
+	holdPickupDays, e := strconv.ParseInt(HoldPickupDays, 10, 64)
+	if e != nil || holdPickupDays < 1 {
+		return fmt.Errorf("设置无效:预约保留天数")
+	}
+
+	idempotencyHours, e := strconv.ParseInt(IdempotencyHours, 10, 64)
+	if e != nil || idempotencyHours < 1 {
+		return fmt.Errorf("设置无效:幂等键保留小时数")
+	}
+
+	if MailSender != "smtp" && MailSender != "file" {
+		return fmt.Errorf("设置无效:邮件发送")
+	}
+	if MailSender == "smtp" && (SmtpAddr == "" || SmtpFrom == "") {
+		return fmt.Errorf("没有设置:SMTP地址或发件人")
+	}
+
+	_, e = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow).Parse(RemindSchedule)
+	if e != nil {
+		return fmt.Errorf("设置无效:提醒定时")
+	}
+	remindDueDays, e := strconv.ParseInt(RemindDueDays, 10, 64)
+	if e != nil || remindDueDays < 0 {
+		return fmt.Errorf("设置无效:到期前提醒天数")
+	}
+	if Notifier != "email" && Notifier != "sms" && Notifier != "file" {
+		return fmt.Errorf("设置无效:提醒通知")
+	}
+	if Notifier == "sms" && SmsGatewayUrl == "" {
+		return fmt.Errorf("没有设置:短信网关地址")
+	}
+
+	webhookIntervalSeconds, e := strconv.ParseInt(WebhookIntervalSeconds, 10, 64)
+	if e != nil || webhookIntervalSeconds < 1 {
+		return fmt.Errorf("设置无效:事件发送间隔秒数")
+	}
+	webhookMaxAttempts, e := strconv.ParseInt(WebhookMaxAttempts, 10, 64)
+	if e != nil || webhookMaxAttempts < 1 {
+		return fmt.Errorf("设置无效:事件发送最多尝试次数")
+	}
+
 	return nil
 }
@@ -0,0 +1,41 @@
+package holder
+
+import (
+	"context"
+	"fmt"
+	toolSql "gs/tool/sql"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Holder 在借用户
+type Holder struct {
+	Username string // 用户名
+	Count    int32  // 在借数量
+	DueDate  string // 最早应还日期, 没有应还日期的在借不参与比较, 都没有时为空
+}
+
+// Holders 在借该图书的用户, 按用户名排序
+//
+// 使用用户在借图书的GIN索引(包含查询)定位用户, 不扫描全部用户在借
+func Holders(ctx context.Context, db *pgxpool.Pool, code string) ([]Holder, error) {
+	rows, e := db.Query(ctx, fmt.Sprintf(`select u.j->>'username', sum(cast(b->>'count' as integer)), coalesce(min(nullif(b->>'due_date', '')), '')
+from %s as u, jsonb_array_elements(u.j->'books') as b
+where u.j->'books' @> '[{"code": "%s"}]' and b->>'code' = '%s' and cast(b->>'count' as integer) > 0
+group by u.j->>'username' order by u.j->>'username'`, toolSql.TableNameUserBorrow, code, code))
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	var result []Holder
+	for rows.Next() {
+		var v Holder
+		e = rows.Scan(&v.Username, &v.Count, &v.DueDate)
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,91 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gs/tool"
+	toolApi "gs/tool/api"
+	"gs/tool/env"
+	toolSql "gs/tool/sql"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrMismatch 幂等键已用于不同的请求
+var ErrMismatch = errors.New("幂等键已用于不同的请求")
+
+// ErrKey 幂等键无效
+var ErrKey = errors.New("幂等键必须是1到64个字母, 数字, 下划线或减号")
+
+var keyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// GetKey 读取元数据中的幂等键, 没有时为空, 格式无效时返回 ErrKey
+func GetKey(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	keyArray := md.Get("x-idempotency-key")
+	if len(keyArray) == 0 {
+		return "", nil
+	}
+	if !keyRegexp.MatchString(keyArray[0]) {
+		return "", ErrKey
+	}
+	return keyArray[0], nil
+}
+
+// Check 在事务中登记幂等键, 幂等键按接口和用户区分
+//
+// 保留期内已经成功处理过时返回原来的结果(JSON), 否则登记并返回空, 处理成功后在同一事务中调用 Save.
+// 同一幂等键的并发请求会等待前一个事务结束. 请求内容不同时返回 ErrMismatch.
+func Check(ctx context.Context, t pgx.Tx, key, username string, in proto.Message) (string, error) {
+	method, _ := grpc.Method(ctx)
+	inText, _ := toolApi.ProtoToJson(in)
+	requestHash := tool.Sha256Hash(inText)
+
+	// 删除过期的幂等键
+	retentionHours, _ := strconv.Atoi(env.IdempotencyHours)
+	now := time.Now()
+	_, e := t.Exec(ctx, fmt.Sprintf(`delete from %s where j->>'date_text' < $1;`, toolSql.TableNameIdempotency), now.Add(-time.Duration(retentionHours)*time.Hour).Format("2006-01-02T15:04:05"))
+	if e != nil {
+		return "", e
+	}
+
+	// 登记
+	ct, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values(jsonb_build_object('key', $1::text, 'method', $2::text, 'username', $3::text, 'request_hash', $4::text, 'response', '', 'date_text', $5::text)) ON CONFLICT ((j->>'key'), (j->>'method'), (j->>'username')) DO NOTHING;`,
+		toolSql.TableNameIdempotency), key, method, username, requestHash, now.Format("2006-01-02T15:04:05"))
+	if e != nil {
+		return "", e
+	}
+	if ct.RowsAffected() > 0 {
+		return "", nil
+	}
+
+	// 已经处理过
+	var oldRequestHash, response string
+	e = t.QueryRow(ctx, fmt.Sprintf(`select j->>'request_hash', j->>'response' from %s where j->>'key' = $1 and j->>'method' = $2 and j->>'username' = $3`, toolSql.TableNameIdempotency), key, method, username).Scan(&oldRequestHash, &response)
+	if e != nil {
+		return "", e
+	}
+	if oldRequestHash != requestHash {
+		return "", ErrMismatch
+	}
+	return response, nil
+}
+
+// Save 在事务中保存处理结果
+func Save(ctx context.Context, t pgx.Tx, key, username string, out proto.Message) error {
+	method, _ := grpc.Method(ctx)
+	outText, _ := toolApi.ProtoToJson(out)
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('response', $1::text) where j->>'key' = $2 and j->>'method' = $3 and j->>'username' = $4;`,
+		toolSql.TableNameIdempotency), outText, key, method, username)
+	return e
+}
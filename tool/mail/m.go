@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"fmt"
+	"gs/tool/env"
+	"net"
+	"net/smtp"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sender 邮件发送
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SmtpSender 通过SMTP发送
+type SmtpSender struct {
+	Addr     string // 地址, 例如 smtp.example.com:587
+	Username string // 用户名, 为空时不认证
+	Password string // 密码
+	From     string // 发件人
+}
+
+func (s *SmtpSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, e := net.SplitHostPort(s.Addr)
+		if e != nil {
+			return e
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n", s.From, to, subject, body)
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to}, []byte(msg))
+}
+
+// FileSender 写入文件, 用于本地测试
+type FileSender struct {
+	Path string // 文件路径, 为空时写入标准输出
+
+	lock sync.Mutex
+}
+
+func (s *FileSender) Send(to, subject, body string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	text := fmt.Sprintf("时间: %s\n收件人: %s\n主题: %s\n%s\n\n", time.Now().Format("2006-01-02T15:04:05"), to, subject, body)
+	if s.Path == "" {
+		_, e := os.Stdout.WriteString(text)
+		return e
+	}
+
+	f, e := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	_, e = f.WriteString(text)
+	return e
+}
+
+var (
+	lock   sync.RWMutex
+	sender Sender
+)
+
+// SetSender 设置邮件发送
+func SetSender(s Sender) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	sender = s
+}
+
+// GetSender 获取邮件发送, 没有设置时按环境变量创建
+func GetSender() Sender {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if sender == nil {
+		if env.MailSender == "smtp" {
+			sender = &SmtpSender{Addr: env.SmtpAddr, Username: env.SmtpUsername, Password: env.SmtpPassword, From: env.SmtpFrom}
+		} else {
+			sender = &FileSender{Path: env.MailFilePath}
+		}
+	}
+	return sender
+}
+
+// Send 发送邮件
+func Send(to, subject, body string) error {
+	return GetSender().Send(to, subject, body)
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gs/tool/env"
+	"gs/tool/mail"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recipient 接收人
+type Recipient struct {
+	Username    string // 用户名
+	Email       string // 电子邮箱
+	MobilePhone string // 手机号码
+}
+
+// Notifier 通知
+type Notifier interface {
+	Notify(to Recipient, subject, body string) error
+}
+
+// ErrNoAddress 接收人没有该通知方式的地址
+var ErrNoAddress = fmt.Errorf("接收人没有通知地址")
+
+// MailNotifier 通过邮件发送通知
+type MailNotifier struct{}
+
+func (n *MailNotifier) Notify(to Recipient, subject, body string) error {
+	if to.Email == "" {
+		return ErrNoAddress
+	}
+	return mail.Send(to.Email, subject, body)
+}
+
+// SmsNotifier 通过短信网关发送通知, 使用 NewSmsNotifier 创建
+type SmsNotifier struct {
+	Url string // 网关地址, 以JSON {"mobile_phone","text"} POST
+
+	client *http.Client
+}
+
+// NewSmsNotifier 创建短信通知, 请求超时为10秒
+func NewSmsNotifier(url string) *SmsNotifier {
+	return &SmsNotifier{Url: url, client: &http.Client{Timeout: time.Second * 10}}
+}
+
+func (n *SmsNotifier) Notify(to Recipient, subject, body string) error {
+	if to.MobilePhone == "" {
+		return ErrNoAddress
+	}
+
+	data, e := json.Marshal(map[string]string{"mobile_phone": to.MobilePhone, "text": fmt.Sprintf("%s\n%s", subject, body)})
+	if e != nil {
+		return e
+	}
+	response, e := n.client.Post(n.Url, "application/json", bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("短信网关返回状态:%d", response.StatusCode)
+	}
+	return nil
+}
+
+// FileNotifier 写入文件, 用于本地测试
+type FileNotifier struct {
+	Path string // 文件路径, 为空时写入标准输出
+
+	lock sync.Mutex
+}
+
+func (n *FileNotifier) Notify(to Recipient, subject, body string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	text := fmt.Sprintf("时间: %s\n用户名: %s\n主题: %s\n%s\n\n", time.Now().Format("2006-01-02T15:04:05"), to.Username, subject, body)
+	if n.Path == "" {
+		_, e := os.Stdout.WriteString(text)
+		return e
+	}
+
+	f, e := os.OpenFile(n.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	_, e = f.WriteString(text)
+	return e
+}
+
+var (
+	lock     sync.RWMutex
+	notifier Notifier
+)
+
+// SetNotifier 设置通知
+func SetNotifier(n Notifier) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	notifier = n
+}
+
+// GetNotifier 获取通知, 没有设置时按环境变量创建
+func GetNotifier() Notifier {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if notifier == nil {
+		switch env.Notifier {
+		case "email":
+			notifier = &MailNotifier{}
+		case "sms":
+			notifier = NewSmsNotifier(env.SmsGatewayUrl)
+		default:
+			notifier = &FileNotifier{Path: env.NotifyFilePath}
+		}
+	}
+	return notifier
+}
+
+// Notify 发送通知
+func Notify(to Recipient, subject, body string) error {
+	return GetNotifier().Notify(to, subject, body)
+}
@@ -0,0 +1,41 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/webhook"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Add 在业务事务中记录事件, 事务提交后由事件通知服务异步发送
+func Add(ctx context.Context, t pgx.Tx, eventType string, payload proto.Message) error {
+	payloadText, e := toolApi.ProtoToJson(payload)
+	if e != nil {
+		return e
+	}
+	info := webhook.EventInfo{
+		Id:       uuid.New().String(),
+		DateText: time.Now().Format("2006-01-02T15:04:05"),
+		Type:     eventType,
+		Payload:  payloadText,
+		State:    "待分发",
+	}
+	infoText, e := toolApi.ProtoToJson(&info)
+	if e != nil {
+		return e
+	}
+	tag, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values('%s');`, toolSql.TableNameOutbox, infoText))
+	if e != nil {
+		return e
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf(`事件没有保存`)
+	}
+	return nil
+}
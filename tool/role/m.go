@@ -0,0 +1,66 @@
+package role
+
+const (
+	// 读者
+	Reader = "读者"
+	// 馆员
+	Librarian = "馆员"
+
+	// 全部接口
+	AllMethod = "*"
+)
+
+// 角色权限接口
+var methodMap = map[string][]string{
+	Reader: {
+		"/book.Book/Search",
+		"/book.Book/Get",
+		"/book.Book/BatchGet",
+		"/book.Book/Detail",
+		"/book.Book/SearchCopy",
+		"/book.Book/SearchStock",
+		"/book.Book/DownloadCover",
+		"/borrow.Borrow/OutIn",
+		"/borrow.Borrow/QueryUserBorrow",
+		"/borrow.Borrow/Renew",
+		"/borrow.Borrow/Reserve",
+		"/borrow.Borrow/CancelReserve",
+		"/borrow.Borrow/SearchReserve",
+		"/borrow.Borrow/History",
+		"/category.Category/Search",
+		"/fine.Fine/Search",
+		"/location.Location/Search",
+		"/overdue.Overdue/Search",
+		"/tier.Tier/Search",
+	},
+	Librarian: {AllMethod},
+}
+
+// Name 角色名称, 为空时为读者
+func Name(role string) string {
+	if role == "" {
+		return Reader
+	}
+	return role
+}
+
+// Ok 角色是否有效
+func Ok(role string) bool {
+	_, exists := methodMap[Name(role)]
+	return exists
+}
+
+// Methods 角色权限接口, * 表示全部接口
+func Methods(role string) []string {
+	return append([]string{}, methodMap[Name(role)]...)
+}
+
+// Allowed 角色是否可以调用接口
+func Allowed(role, fullMethod string) bool {
+	for _, method := range methodMap[Name(role)] {
+		if method == AllMethod || method == fullMethod {
+			return true
+		}
+	}
+	return false
+}
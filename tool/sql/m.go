@@ -9,20 +9,61 @@ import (
 
 	"gs/tool/env"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Querier 可以查询单行, 连接池和事务都可以使用
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 const (
 	// 用户
 	TableNameUser = "bs_user"
 	// 图书
 	TableNameBook = "bs_book"
+	// 图书副本
+	TableNameBookCopy = "bs_book_copy"
+	// 库存调整
+	TableNameStockAdjust = "bs_stock_adjust"
+	// 分类
+	TableNameCategory = "bs_category"
+	// 馆
+	TableNameLocation = "bs_location"
+	// 图书在馆库存
+	TableNameBookStock = "bs_book_stock"
+	// 会员等级
+	TableNameTier = "bs_tier"
+	// 用户邮箱验证
+	TableNameUserVerify = "bs_user_verify"
+	// 罚款
+	TableNameFine = "bs_fine"
+	// 预约
+	TableNameReservation = "bs_reservation"
+	// 幂等键
+	TableNameIdempotency = "bs_idempotency"
+	// 提醒
+	TableNameReminder = "bs_reminder"
+	// 事件
+	TableNameOutbox = "bs_outbox"
+	// 事件通知
+	TableNameWebhook = "bs_webhook"
+	// 事件发送
+	TableNameWebhookDelivery = "bs_webhook_delivery"
 	// 借还记录
 	TableNameBorrowOutIn = "bs_borrow_outin"
 	// 用户在借
 	TableNameUserBorrow = "bs_user_borrow"
 )
 
+const (
+	// 默认馆编码
+	DefaultLocationCode = "总馆"
+	// 默认会员等级编码
+	DefaultTierCode = "普通"
+)
+
 var dbPool *pgxpool.Pool
 
 // 创建
@@ -32,28 +73,152 @@ func create() {
 -- 用户
 create table if not exists %s (j jsonb);
 create unique index if not exists iu_%s_username on %s ((j->'username'));
-insert into %s values('{"state":"正常","username":"测试"}') ON CONFLICT ((j->'username')) DO NOTHING;
+create unique index if not exists iu_%s_email on %s ((j->>'email')) where coalesce(j->>'email', '') != '';
+create unique index if not exists iu_%s_card_number on %s ((j->>'card_number')) where coalesce(j->>'card_number', '') != '';
+insert into %s values('{"state":"正常","username":"测试","role":"馆员"}') ON CONFLICT ((j->'username')) DO NOTHING;
+update %s set j = j || '{"role":"馆员"}' where j->>'username' = '测试' and coalesce(j->>'role', '') = '';
 -- 图书
 create table if not exists %s (j jsonb);
 create unique index if not exists iu_%s_code on %s ((j->'code'));
+create index if not exists i_%s_category_codes on %s using gin ((j->'category_codes'));
+-- 图书副本
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_barcode on %s ((j->'barcode'));
+create index if not exists i_%s_code on %s ((j->>'code'));
+-- 库存调整
+create table if not exists %s (j jsonb);
+create index if not exists i_%s_code on %s ((j->>'code'));
+-- 分类
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_code on %s ((j->'code'));
+create index if not exists i_%s_path on %s ((j->>'path') text_pattern_ops);
+-- 馆
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_code on %s ((j->'code'));
+insert into %s values('{"code":"%s","name":"%s","state":"正常"}') ON CONFLICT ((j->'code')) DO NOTHING;
+-- 图书在馆库存(没有在馆库存的图书和没有馆的副本归入默认馆)
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_code_location_code on %s ((j->>'code'), (j->>'location_code'));
+insert into %s select jsonb_build_object('code', b.j->>'code', 'location_code', '%s', 'total_count', coalesce(cast(b.j->>'total_count' as integer), 0), 'borrow_count', coalesce(cast(b.j->>'borrow_count' as integer), 0)) from %s as b where not exists (select 1 from %s as s where s.j->>'code' = b.j->>'code');
+update %s set j = jsonb_set(j, '{location_code}', '"%s"') where coalesce(j->>'location_code', '') = '';
+-- 用户邮箱验证
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_username on %s ((j->'username'));
+-- 会员等级
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_code on %s ((j->'code'));
+insert into %s values('{"code":"%s","name":"%s","max_loan_count":20,"max_title_count":5,"loan_days":30,"state":"正常","fine_per_day":10,"fine_cap":1000,"fine_block_amount":500,"max_renew_count":2}') ON CONFLICT ((j->'code')) DO NOTHING;
+update %s set j = '{"fine_per_day":10,"fine_cap":1000,"fine_block_amount":500}' || j where j->>'code' = '%s';
+update %s set j = '{"max_renew_count":2}' || j where j->>'code' = '%s';
+-- 罚款
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_id on %s ((j->'id'));
+create index if not exists i_%s_username on %s ((j->>'username'));
+-- 预约
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_id on %s ((j->'id'));
+create index if not exists i_%s_code on %s ((j->>'code'));
+-- 幂等键
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_key_method_username on %s ((j->>'key'), (j->>'method'), (j->>'username'));
+create index if not exists i_%s_date_text on %s ((j->>'date_text'));
+-- 提醒
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_lot on %s ((j->>'username'), (j->>'code'), (j->>'location_code'), (j->>'due_date'), (j->>'type'));
+-- 事件
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_id on %s ((j->'id'));
+create index if not exists i_%s_state_date_text on %s ((j->>'state'), (j->>'date_text'));
+-- 事件通知
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_id on %s ((j->'id'));
+-- 事件发送
+create table if not exists %s (j jsonb);
+create unique index if not exists iu_%s_id on %s ((j->'id'));
+create index if not exists i_%s_state_next_date_text on %s ((j->>'state'), (j->>'next_date_text'));
 -- 借还记录
 create table if not exists %s (j jsonb);
+create index if not exists i_%s_username_date_text on %s ((j->>'username'), (j->>'date_text'));
+create index if not exists i_%s_books on %s using gin ((j->'books') jsonb_path_ops);
 -- 用户在借
 create table if not exists %s (j jsonb);
 create unique index if not exists iu_%s_username on %s ((j->'username'));
+create index if not exists i_%s_books on %s using gin ((j->'books') jsonb_path_ops);
 `,
 		// 用户
 		TableNameUser,
 		TableNameUser, TableNameUser,
+		TableNameUser, TableNameUser,
+		TableNameUser, TableNameUser,
+		TableNameUser,
 		TableNameUser,
 		// 图书
 		TableNameBook,
 		TableNameBook, TableNameBook,
+		TableNameBook, TableNameBook,
+		// 图书副本
+		TableNameBookCopy,
+		TableNameBookCopy, TableNameBookCopy,
+		TableNameBookCopy, TableNameBookCopy,
+		// 库存调整
+		TableNameStockAdjust,
+		TableNameStockAdjust, TableNameStockAdjust,
+		// 分类
+		TableNameCategory,
+		TableNameCategory, TableNameCategory,
+		TableNameCategory, TableNameCategory,
+		// 馆
+		TableNameLocation,
+		TableNameLocation, TableNameLocation,
+		TableNameLocation, DefaultLocationCode, DefaultLocationCode,
+		// 图书在馆库存
+		TableNameBookStock,
+		TableNameBookStock, TableNameBookStock,
+		TableNameBookStock, DefaultLocationCode, TableNameBook, TableNameBookStock,
+		TableNameBookCopy, DefaultLocationCode,
+		// 用户邮箱验证
+		TableNameUserVerify,
+		TableNameUserVerify, TableNameUserVerify,
+		// 会员等级
+		TableNameTier,
+		TableNameTier, TableNameTier,
+		TableNameTier, DefaultTierCode, DefaultTierCode,
+		TableNameTier, DefaultTierCode,
+		TableNameTier, DefaultTierCode,
+		// 罚款
+		TableNameFine,
+		TableNameFine, TableNameFine,
+		TableNameFine, TableNameFine,
+		// 预约
+		TableNameReservation,
+		TableNameReservation, TableNameReservation,
+		TableNameReservation, TableNameReservation,
+		// 幂等键
+		TableNameIdempotency,
+		TableNameIdempotency, TableNameIdempotency,
+		TableNameIdempotency, TableNameIdempotency,
+		// 提醒
+		TableNameReminder,
+		TableNameReminder, TableNameReminder,
+		// 事件
+		TableNameOutbox,
+		TableNameOutbox, TableNameOutbox,
+		TableNameOutbox, TableNameOutbox,
+		// 事件通知
+		TableNameWebhook,
+		TableNameWebhook, TableNameWebhook,
+		// 事件发送
+		TableNameWebhookDelivery,
+		TableNameWebhookDelivery, TableNameWebhookDelivery,
+		TableNameWebhookDelivery, TableNameWebhookDelivery,
 		// 借还记录
 		TableNameBorrowOutIn,
+		TableNameBorrowOutIn, TableNameBorrowOutIn,
+		TableNameBorrowOutIn, TableNameBorrowOutIn,
 		// 用户在借
 		TableNameUserBorrow,
 		TableNameUserBorrow, TableNameUserBorrow,
+		TableNameUserBorrow, TableNameUserBorrow,
 	))
 
 	if e != nil {
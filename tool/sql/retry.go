@@ -0,0 +1,56 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"gs/filelog"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// 事务最多重试次数
+	RetryCount = 5
+	// 事务重试的初始退避时间
+	retryBackoff = 20 * time.Millisecond
+)
+
+// Retryable 是否可以重试: 序列化失败或死锁
+//
+// 错误被转为grpc状态时只保留了文本, 所以同时检查文本中的 SQLSTATE
+func Retryable(e error) bool {
+	if e == nil {
+		return false
+	}
+	var pgError *pgconn.PgError
+	if errors.As(e, &pgError) {
+		return pgError.Code == "40001" || pgError.Code == "40P01"
+	}
+	return strings.Contains(e.Error(), "(SQLSTATE 40001)") || strings.Contains(e.Error(), "(SQLSTATE 40P01)")
+}
+
+// Retry 执行事务, 序列化失败或死锁时退避后重试, 最多重试 RetryCount 次
+//
+// fn 每次执行都必须开始新的事务
+func Retry(ctx context.Context, fn func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		e := fn()
+		if !Retryable(e) || i >= RetryCount {
+			return e
+		}
+
+		// 退避时间加随机抖动, 避免再次冲突
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		filelog.Debug("事务冲突, 重试", i+1, wait, e.Error())
+		select {
+		case <-ctx.Done():
+			return e
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
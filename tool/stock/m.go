@@ -0,0 +1,107 @@
+package stock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	toolSql "gs/tool/sql"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrCount 调整后借出数量小于0或大于库存数量
+var ErrCount = errors.New("库存数量不足")
+
+// LocationCode 馆编码, 为空时为默认馆
+func LocationCode(locationCode string) string {
+	if locationCode == "" {
+		return toolSql.DefaultLocationCode
+	}
+	return locationCode
+}
+
+// LocationOk 馆是否有效(正常状态)
+func LocationOk(ctx context.Context, t pgx.Tx, locationCode string) (bool, error) {
+	var count int
+	e := t.QueryRow(ctx, fmt.Sprintf(`select count(*) from %s where j->>'code' = '%s' and j->>'state' = '正常'`, toolSql.TableNameLocation, locationCode)).Scan(&count)
+	if e != nil {
+		return false, e
+	}
+	return count > 0, nil
+}
+
+// 根据在馆库存更新图书库存数量和借出数量
+func syncBook(ctx context.Context, t pgx.Tx, code string) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s as b set j = b.j || jsonb_build_object(
+'total_count', (select coalesce(sum(cast(s.j->>'total_count' as integer)), 0) from %s as s where s.j->>'code' = b.j->>'code'),
+'borrow_count', (select coalesce(sum(cast(s.j->>'borrow_count' as integer)), 0) from %s as s where s.j->>'code' = b.j->>'code')
+) where b.j->>'code' = '%s';`, toolSql.TableNameBook, toolSql.TableNameBookStock, toolSql.TableNameBookStock, code))
+	return e
+}
+
+// Change 调整在馆库存, 并更新图书库存数量和借出数量
+//
+// 调整后借出数量小于0或大于库存数量时返回 ErrCount
+func Change(ctx context.Context, t pgx.Tx, code, locationCode string, totalDiff, borrowDiff int32) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values(jsonb_build_object('code', '%s', 'location_code', '%s', 'total_count', 0, 'borrow_count', 0)) ON CONFLICT ((j->>'code'), (j->>'location_code')) DO NOTHING;`, toolSql.TableNameBookStock, code, locationCode))
+	if e != nil {
+		return e
+	}
+
+	ct, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('total_count', cast(j->>'total_count' as integer) + %d, 'borrow_count', cast(j->>'borrow_count' as integer) + %d) where j->>'code' = '%s' and j->>'location_code' = '%s' and cast(j->>'borrow_count' as integer) + %d >= 0 and cast(j->>'borrow_count' as integer) + %d <= cast(j->>'total_count' as integer) + %d;`,
+		toolSql.TableNameBookStock, totalDiff, borrowDiff, code, locationCode, borrowDiff, borrowDiff, totalDiff))
+	if e != nil {
+		return e
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrCount
+	}
+
+	return syncBook(ctx, t, code)
+}
+
+// SetBorrowCount 设置在馆借出数量, 并更新图书库存数量和借出数量, 用于对账修复
+//
+// 借出数量小于0或大于在馆库存数量时返回 ErrCount
+func SetBorrowCount(ctx context.Context, t pgx.Tx, code, locationCode string, borrowCount int32) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`insert into %s values(jsonb_build_object('code', '%s', 'location_code', '%s', 'total_count', 0, 'borrow_count', 0)) ON CONFLICT ((j->>'code'), (j->>'location_code')) DO NOTHING;`, toolSql.TableNameBookStock, code, locationCode))
+	if e != nil {
+		return e
+	}
+
+	ct, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || jsonb_build_object('borrow_count', %d) where j->>'code' = '%s' and j->>'location_code' = '%s' and %d >= 0 and %d <= cast(j->>'total_count' as integer);`, toolSql.TableNameBookStock, borrowCount, code, locationCode, borrowCount, borrowCount))
+	if e != nil {
+		return e
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrCount
+	}
+
+	return syncBook(ctx, t, code)
+}
+
+// Sync 根据在馆库存更新图书库存数量和借出数量
+func Sync(ctx context.Context, t pgx.Tx, code string) error {
+	return syncBook(ctx, t, code)
+}
+
+// SyncCopy 根据副本状态重新计算在馆库存(在架+借出), 并更新图书库存数量和借出数量
+func SyncCopy(ctx context.Context, t pgx.Tx, code string) error {
+	_, e := t.Exec(ctx, fmt.Sprintf(`update %s set j = j || '{"total_count": 0, "borrow_count": 0}' where j->>'code' = '%s';`, toolSql.TableNameBookStock, code))
+	if e != nil {
+		return e
+	}
+
+	_, e = t.Exec(ctx, fmt.Sprintf(`insert into %s select jsonb_build_object(
+'code', j->>'code',
+'location_code', j->>'location_code',
+'total_count', count(*) filter (where j->>'state' in ('在架', '借出')),
+'borrow_count', count(*) filter (where j->>'state' = '借出')
+) from %s where j->>'code' = '%s' group by j->>'code', j->>'location_code'
+ON CONFLICT ((j->>'code'), (j->>'location_code')) DO UPDATE SET j = EXCLUDED.j;`, toolSql.TableNameBookStock, toolSql.TableNameBookCopy, code))
+	if e != nil {
+		return e
+	}
+
+	return syncBook(ctx, t, code)
+}
@@ -0,0 +1,28 @@
+package tier
+
+import (
+	"context"
+	"fmt"
+	"gs/proto/tier"
+	toolApi "gs/tool/api"
+	toolSql "gs/tool/sql"
+)
+
+// UserTier 用户的会员等级, 用户没有设置时为默认等级
+//
+// 用户或等级不存在时返回 pgx.ErrNoRows
+func UserTier(ctx context.Context, q toolSql.Querier, username string) (*tier.Info, error) {
+	var jsonText string
+	e := q.QueryRow(ctx, fmt.Sprintf(`select r.j from %s as u join %s as r on r.j->>'code' = coalesce(nullif(u.j->>'tier_code', ''), '%s') where u.j->>'username' = '%s'`,
+		toolSql.TableNameUser, toolSql.TableNameTier, toolSql.DefaultTierCode, username)).Scan(&jsonText)
+	if e != nil {
+		return nil, e
+	}
+
+	var info tier.Info
+	e = toolApi.JsonToProto(jsonText, &info)
+	if e != nil {
+		return nil, e
+	}
+	return &info, nil
+}
@@ -54,6 +54,14 @@ func EmailOk(txt string) bool {
 	return e == nil
 }
 
+// UsernameOk 用户名是否正确
+//
+// 1到64个字母, 数字, 下划线, 点或减号, 字母包括中文
+func UsernameOk(txt string) bool {
+	reg := regexp.MustCompile(`^[\p{L}\p{N}_.-]{1,64}$`)
+	return reg.MatchString(txt)
+}
+
 // MobilePhoneOk 手机号码是否正确
 func MobilePhoneOk(mobileNum string) bool {
 	regular := "^((13[0-9])|(14[5,7])|(15[0-3,5-9])|(17[0,3,5-8])|(18[0-9])|166|198|199|(147)|(888)|(58[0-9]))\\d{8}$"